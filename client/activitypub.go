@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Either "auto", "manual" or "deny"
+func (client *Client) SetFollowPolicy(policy string) error {
+	return client.post("/follow-policy", map[string]interface{}{
+		"id":     client.Id,
+		"policy": policy,
+	}, nil)
+}
+
+// A follow request waiting for the approval of the agent
+type FollowRequest struct {
+	Id    uint64 `json:"id"`
+	Actor string `json:"actor"`
+}
+
+func (client *Client) FollowRequests() ([]FollowRequest, error) {
+	var result struct {
+		Data []FollowRequest `json:"data"`
+	}
+	err := client.post("/follow-requests", map[string]interface{}{
+		"id": client.Id,
+	}, &result)
+	return result.Data, err
+}
+
+// Approves (accept is true) or rejects a follow request, returns the id of
+// the delivery of the answer
+func (client *Client) AnswerFollow(follow uint64, accept bool) (uint64, error) {
+	path := "/follow-requests/reject"
+	if accept {
+		path = "/follow-requests/approve"
+	}
+	var result struct {
+		Delivery uint64 `json:"delivery"`
+	}
+	err := client.post(path, map[string]interface{}{
+		"id":     client.Id,
+		"follow": follow,
+	}, &result)
+	return result.Delivery, err
+}
+
+// Url of a local actor, actorType is either "person" or "economicresource"
+func (client *Client) ActorUrl(actorType string, id string) string {
+	return fmt.Sprintf("%s/%s/%s", client.Url, actorType, id)
+}
+
+// Posts an activity to the outbox of an actor, the agent has to be the
+// person or the primary accountable of the economic resource. The result
+// is the whole response of the inbox.
+func (client *Client) PostActivity(actorType string, id string, activity map[string]interface{}) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	err := client.post(fmt.Sprintf("/%s/%s/outbox", actorType, id), activity, &result)
+	return result, err
+}
+
+// Returns a page of the activities received by an actor, the newest first,
+// older than maxId if it is not zero
+func (client *Client) Inbox(actorType string, id string, maxId uint64) (map[string]interface{}, error) {
+	query := url.Values{}
+	query.Set("page", "true")
+	if maxId > 0 {
+		query.Set("max_id", fmt.Sprint(maxId))
+	}
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err := client.get(fmt.Sprintf("/%s/%s/inbox", actorType, id), query, &result)
+	return result.Data, err
+}
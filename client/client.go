@@ -0,0 +1,177 @@
+// Package client talks to the zenflows inbox on behalf of an agent. The
+// requests are signed with the EdDSA key of the agent, as zenflows-crypto
+// does, and carry the timestamp and the nonce required by the inbox.
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	zenroom "github.com/dyne/Zenroom/bindings/golang/zenroom"
+)
+
+// The same script of zenflows-crypto (sign_graphql.zen)
+const SIGN = `
+Scenario eddsa: sign a graph query
+Given I have a 'base64' named 'gql'
+Given I have a 'keyring'
+
+# Fix Apollo's mingling with query string
+When I remove spaces in 'gql'
+and I compact ascii strings in 'gql'
+
+When I create the eddsa signature of 'gql'
+And I create the hash of 'gql'
+
+Then print 'eddsa signature' as 'base64'
+Then print 'gql' as 'base64'
+Then print 'hash' as 'hex'
+`
+
+const SIGN_HEADER = "zenflows-sign"
+
+type Client struct {
+	// Base url of the inbox, e.g. http://localhost:5000
+	Url string
+	// Id of the agent in zenflows
+	Id string
+	// EdDSA secret key of the agent
+	Sk         string
+	HttpClient *http.Client
+}
+
+func New(url string, id string, sk string) *Client {
+	return &Client{
+		Url:        strings.TrimSuffix(url, "/"),
+		Id:         id,
+		Sk:         sk,
+		HttpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// A failed request, Code is one of the codes documented in the README
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+// Returns the signature of data, to be put in the header zenflows-sign
+func (client *Client) Sign(data []byte) (string, error) {
+	input := fmt.Sprintf(`{"gql": "%s"}`, b64.StdEncoding.EncodeToString(data))
+	keys := fmt.Sprintf(`{"keyring": {"eddsa": "%s"}}`, client.Sk)
+	result, success := zenroom.ZencodeExec(SIGN, "", input, keys)
+	if !success {
+		return "", fmt.Errorf("Could not sign the request: %s", result.Logs)
+	}
+	var output map[string]string
+	if err := json.Unmarshal([]byte(result.Output), &output); err != nil {
+		return "", err
+	}
+	return output["eddsa_signature"], nil
+}
+
+func nonce() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Adds the timestamp and the nonce to the request and signs it
+func (client *Client) signedBody(request interface{}) ([]byte, string, error) {
+	tmp, err := json.Marshal(request)
+	if err != nil {
+		return nil, "", err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(tmp, &fields); err != nil {
+		return nil, "", err
+	}
+	fields["timestamp"] = time.Now().UnixMilli()
+	fields["nonce"] = nonce()
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	signature, err := client.Sign(body)
+	return body, signature, err
+}
+
+// Sends the request and decodes the response in response, which is the
+// whole json object returned by the inbox
+func (client *Client) do(r *http.Request, response interface{}) error {
+	resp, err := client.HttpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		Code    string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return &Error{resp.StatusCode, "", string(body)}
+	}
+	if !envelope.Success {
+		return &Error{resp.StatusCode, envelope.Code, envelope.Error}
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
+
+// Posts the request signed by the agent
+func (client *Client) post(path string, request interface{}, response interface{}) error {
+	body, signature, err := client.signedBody(request)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", client.Url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(SIGN_HEADER, signature)
+	return client.do(r, response)
+}
+
+// Gets the path signed by the agent: the signature is of the path with the
+// query, so the inbox has to be at the root of Url
+func (client *Client) get(path string, query url.Values, response interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("timestamp", fmt.Sprint(time.Now().UnixMilli()))
+	query.Set("nonce", nonce())
+	requestUri := path + "?" + query.Encode()
+	signature, err := client.Sign([]byte(requestUri))
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("GET", client.Url+requestUri, nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(SIGN_HEADER, signature)
+	return client.do(r, response)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const TEST_SK = "CMZkoX14iviTWWuDNezrCksLMBt2gLxfQCViC5urxuJ3"
+
+// Inbox that answers every request with status and body, the last request
+// is in r and its body in body
+type testServer struct {
+	*httptest.Server
+	status int
+	answer string
+	r      *http.Request
+	body   map[string]interface{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	server := &testServer{status: http.StatusOK, answer: `{"success": true}`}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.r = r
+		server.body = nil
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			json.Unmarshal(data, &server.body)
+		}
+		w.WriteHeader(server.status)
+		io.WriteString(w, server.answer)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSignedRequests(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL+"/", "alice", TEST_SK)
+
+	server.answer = `{"success": true, "count": 1, "receivers": [{"receiver": "bob", "status": "delivered"}]}`
+	sent, err := client.Send([]string{"bob"}, map[string]interface{}{"message": "hi"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Count != 1 || len(sent.Receivers) != 1 || sent.Receivers[0].Status != "delivered" {
+		t.Fatalf("Unexpected result %+v", sent)
+	}
+	if server.r.Method != "POST" || server.r.URL.Path != "/send" || server.r.Header.Get(SIGN_HEADER) == "" {
+		t.Fatalf("Unexpected request %s %s", server.r.Method, server.r.URL)
+	}
+	body := server.body
+	if body["sender"] != "alice" || body["atomic"] != true || body["timestamp"] == nil || body["nonce"] == "" {
+		t.Fatalf("Unexpected body %v", body)
+	}
+
+	// Each request has its own nonce
+	if _, err := client.Send([]string{"bob"}, map[string]interface{}{"message": "hi"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if server.body["nonce"] == body["nonce"] {
+		t.Fatal("The nonce is reused")
+	}
+
+	// The GET requests sign the path with the query
+	server.answer = `{"success": true, "data": {"type": "OrderedCollectionPage"}}`
+	page, err := client.Inbox("person", "alice", 7)
+	if err != nil || page["type"] != "OrderedCollectionPage" {
+		t.Fatal(page, err)
+	}
+	query := server.r.URL.Query()
+	if server.r.URL.Path != "/person/alice/inbox" || query.Get("max_id") != "7" || query.Get("timestamp") == "" ||
+		query.Get("nonce") == "" || server.r.Header.Get(SIGN_HEADER) == "" {
+		t.Fatalf("Unexpected request %s", server.r.URL)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL, "alice", TEST_SK)
+
+	server.status = http.StatusUnauthorized
+	server.answer = `{"success": false, "error": "Invalid signature", "code": "bad_signature"}`
+	_, err := client.CountUnread()
+	clientErr, ok := err.(*Error)
+	if !ok || clientErr.Status != http.StatusUnauthorized || clientErr.Code != "bad_signature" || clientErr.Message != "Invalid signature" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// An answer that is not of the inbox is the message of the error
+	server.status = http.StatusBadGateway
+	server.answer = "Bad gateway"
+	err = client.SetRead(1, true)
+	clientErr, ok = err.(*Error)
+	if !ok || clientErr.Status != http.StatusBadGateway || clientErr.Code != "" || clientErr.Message != "Bad gateway" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
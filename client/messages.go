@@ -0,0 +1,187 @@
+package client
+
+import "time"
+
+// Outcome of the delivery of a message to one of its receivers: delivered,
+// duplicate, rejected, aborted or queued
+type Delivery struct {
+	Receiver string `json:"receiver"`
+	Status   string `json:"status"`
+}
+
+type SendResult struct {
+	// Number of receivers the message was delivered (or queued) to
+	Count     int        `json:"count"`
+	Receivers []Delivery `json:"receivers"`
+}
+
+// Sends the content to the receivers, which are ids of agents or urls of
+// actors on other servers. If atomic is set and some receiver is rejected
+// the message is not delivered to anyone.
+func (client *Client) Send(receivers []string, content map[string]interface{}, atomic bool) (*SendResult, error) {
+	var result SendResult
+	err := client.post("/send", map[string]interface{}{
+		"sender":    client.Id,
+		"receivers": receivers,
+		"content":   content,
+		"atomic":    atomic,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Sends the content to the receivers, the message is deleted at expiresAt
+func (client *Client) SendExpiring(receivers []string, content map[string]interface{}, expiresAt time.Time) (*SendResult, error) {
+	var result SendResult
+	err := client.post("/send", map[string]interface{}{
+		"sender":     client.Id,
+		"receivers":  receivers,
+		"content":    content,
+		"expires_at": expiresAt,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Sends the content to the receivers as a reply to the message messageId,
+// in its thread
+func (client *Client) Reply(messageId int, receivers []string, content map[string]interface{}) (*SendResult, error) {
+	var result SendResult
+	err := client.post("/send", map[string]interface{}{
+		"sender":      client.Id,
+		"receivers":   receivers,
+		"content":     content,
+		"in_reply_to": messageId,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type Message struct {
+	Id      int                    `json:"id"`
+	Sender  string                 `json:"sender"`
+	Content map[string]interface{} `json:"content"`
+	Read    bool                   `json:"read"`
+	// The id of the first message of the thread
+	ThreadId  int  `json:"thread_id"`
+	InReplyTo *int `json:"in_reply_to"`
+	// When the inbox has stored the message
+	Created time.Time `json:"created"`
+	// Nil if the message does not expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type ReadQuery struct {
+	OnlyUnread bool `json:"only_unread"`
+	// At most 100 messages are returned, the default
+	Limit int `json:"limit,omitempty"`
+	// The NextCursor of the previous page
+	Cursor *int `json:"cursor,omitempty"`
+	// Either "asc" (default) or "desc"
+	Order string `json:"order,omitempty"`
+	// Only the messages created in [Since, Until)
+	Since *time.Time `json:"since,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type ReadPage struct {
+	Messages []Message `json:"messages"`
+	// Nil if there are no more messages
+	NextCursor *int `json:"next_cursor"`
+	// Ids of the messages that have a receiver but do not exist
+	Missing []int `json:"missing"`
+}
+
+// Reads a page of the messages of the agent
+func (client *Client) Read(query ReadQuery) (*ReadPage, error) {
+	var page ReadPage
+	err := client.post("/read", struct {
+		ReadQuery
+		Receiver string `json:"receiver"`
+	}{query, client.Id}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (client *Client) SetRead(messageId int, read bool) error {
+	return client.post("/set-read", map[string]interface{}{
+		"receiver":   client.Id,
+		"message_id": messageId,
+		"read":       read,
+	}, nil)
+}
+
+func (client *Client) CountUnread() (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	err := client.post("/count-unread", map[string]interface{}{
+		"receiver": client.Id,
+	}, &result)
+	return result.Count, err
+}
+
+func (client *Client) Delete(messageId int) error {
+	return client.post("/delete", map[string]interface{}{
+		"receiver":   client.Id,
+		"message_id": messageId,
+	}, nil)
+}
+
+// Drops the public key of the agent cached by the inbox, after a key
+// rotation: Sk has to be the new key
+func (client *Client) InvalidatePubkey() error {
+	return client.post("/invalidate-pubkey", map[string]interface{}{
+		"id": client.Id,
+	}, nil)
+}
+
+type Thread struct {
+	Id     int     `json:"thread_id"`
+	Latest Message `json:"latest"`
+	Unread int     `json:"unread"`
+}
+
+type ThreadsPage struct {
+	Threads []Thread `json:"threads"`
+	// Nil if there are no more threads
+	NextCursor *int `json:"next_cursor"`
+}
+
+// Lists the threads of the agent, the one with the newest message first.
+// cursor is the NextCursor of the previous page.
+func (client *Client) Threads(limit int, cursor *int) (*ThreadsPage, error) {
+	var page ThreadsPage
+	err := client.post("/threads", map[string]interface{}{
+		"receiver": client.Id,
+		"limit":    limit,
+		"cursor":   cursor,
+	}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Returns the messages of a thread of the agent, the oldest first
+func (client *Client) Thread(threadId int, limit int, cursor *int) (*ReadPage, error) {
+	var page ReadPage
+	err := client.post("/thread", map[string]interface{}{
+		"receiver":  client.Id,
+		"thread_id": threadId,
+		"limit":     limit,
+		"cursor":    cursor,
+	}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
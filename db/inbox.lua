@@ -1,4 +1,649 @@
+-- Stored procedures of the inbox, they are registered as global functions by
+-- start() and called by the go service with call17
+local json = require('json')
+local fiber = require('fiber')
+local log = require('log')
+
+-- Events older than this (in seconds) are removed
+local EVENTS_TTL = 3600
+-- Deliveries completed since more than this (in seconds) are removed
+local DELIVERIES_TTL = 86400
+
+-- Records an event for receiver, every instance of the service polls the
+-- events space and pushes them to its subscribers
+local function notify(receiver, event_type, data)
+    box.space.events:insert{box.NULL, receiver, event_type, json.encode(data), fiber.time()}
+end
+
+-- The message as it is returned to the service
+local function message_of(m, read)
+    return {
+        id = m[1],
+        content = m[2],
+        sender = m[3],
+        thread_id = m[4],
+        in_reply_to = m[5],
+        created = m[6],
+        expires_at = m[7],
+        read = read,
+    }
+end
+
+-- Returns false if the message m has expired, it is still stored until
+-- expire removes it
+local function alive(m)
+    return m[7] == nil or m[7] > fiber.time()
+end
+
+-- Returns the ids of the first message created at since or later and of the
+-- last one created before until, the bounds that are nil are not checked.
+-- The third result is false if there are no messages in the range.
+local function created_range(since, until_)
+    local index = box.space.messages.index.created
+    local first, last = box.NULL, box.NULL
+    if since ~= nil then
+        local m = index:select({since}, {iterator = 'GE', limit = 1})[1]
+        if m == nil then
+            return first, last, false
+        end
+        first = m[1]
+    end
+    if until_ ~= nil then
+        local m = index:select({until_}, {iterator = 'LT', limit = 1})[1]
+        if m == nil or m[6] == nil then
+            return first, last, false
+        end
+        last = m[1]
+    end
+    return first, last, first == nil or last == nil or first <= last
+end
+
+-- Reads a page of the messages of receiver joining receivers and messages.
+-- The messages are sorted by id, cursor is the id of the last message of the
+-- previous page (or nil). Receivers whose message does not exist anymore are
+-- skipped and their ids are returned in missing. Only the messages created
+-- in [since, until_) are read, the bounds can be nil. The expired messages
+-- are skipped.
+local function read(receiver, only_unread, cursor, limit, desc, since, until_)
+    local messages = {}
+    local missing = {}
+    local next_cursor = box.NULL
+
+    -- The times are turned into a range of ids
+    local first, last, found = created_range(since, until_)
+    if not found then
+        return messages, next_cursor, missing
+    end
+
+    local index = box.space.receivers.index.receiver_messages
+    local key = {receiver}
+    if only_unread then
+        index = box.space.receivers.index.receiver_unread
+        key = {receiver, false}
+    end
+    local prefix_len = #key
+
+    local iterator
+    if desc then
+        if cursor ~= nil and (last == nil or cursor <= last) then
+            iterator = 'LT'
+            table.insert(key, cursor)
+        else
+            iterator = 'LE'
+            table.insert(key, last)
+        end
+    else
+        if cursor ~= nil and (first == nil or cursor >= first) then
+            iterator = 'GT'
+            table.insert(key, cursor)
+        else
+            iterator = 'GE'
+            table.insert(key, first)
+        end
+    end
+    -- Without a bound the key is just the prefix
+    if key[#key] == nil then
+        table.remove(key)
+    end
+
+    for _, r in index:pairs(key, {iterator = iterator}) do
+        -- The iterator goes on with the next receivers, stop at the end
+        -- of the prefix or of the range
+        if r[2] ~= receiver or (prefix_len == 2 and r[3]) then
+            break
+        end
+        if (desc and first ~= nil and r[1] < first) or (not desc and last ~= nil and r[1] > last) then
+            break
+        end
+        if #messages == limit then
+            next_cursor = messages[#messages].id
+            break
+        end
+        local m = box.space.messages:get(r[1])
+        if m == nil then
+            table.insert(missing, r[1])
+        elseif alive(m) then
+            table.insert(messages, message_of(m, r[3] == true))
+        end
+    end
+    return messages, next_cursor, missing
+end
+
+-- Returns the number of the unread messages of receiver, up to limit. The
+-- expired messages are not counted, as in read.
+local function count_unread(receiver, limit)
+    local count = 0
+    for _, r in box.space.receivers.index.receiver_unread:pairs({receiver, false}) do
+        if count == limit then
+            break
+        end
+        local m = box.space.messages:get(r[1])
+        if m ~= nil and alive(m) then
+            count = count + 1
+        end
+    end
+    return count
+end
+
+-- The state of the threads of each agent (its newest message in the thread
+-- and the number of the unread ones) is kept in agent_threads, within the
+-- transaction that changes the messages, so that threads reads only a page.
+-- Two transactions that change the same thread conflict, the one aborted is
+-- called again by the service (see callRetry in storage.go).
+
+-- Records that id is the newest message of the thread of agent and that
+-- unread more messages of the thread are unread
+local function touch_thread(agent, thread_id, id, unread)
+    local t = box.space.agent_threads:get({agent, thread_id})
+    if t == nil then
+        box.space.agent_threads:insert{agent, thread_id, id, unread}
+    else
+        box.space.agent_threads:update({agent, thread_id}, {{'=', 3, math.max(t[3], id)}, {'+', 4, unread}})
+    end
+end
+
+-- Changes by delta the number of the unread messages of the thread of agent
+local function add_unread(agent, thread_id, delta)
+    local t = box.space.agent_threads:get({agent, thread_id})
+    if t ~= nil then
+        box.space.agent_threads:update({agent, thread_id}, {{'=', 4, math.max(t[4] + delta, 0)}})
+    end
+end
+
+-- The time of the newest message, it is kept here and not read from the
+-- messages within the transaction of send, where it would conflict with the
+-- concurrent sends. It is set by start.
+local last_created = 0
+
+-- Inserts the message and delivers it to each receiver in a single
+-- transaction. For each receiver the outcome is one of delivered, duplicate
+-- (the receiver appears more than once) or rejected. When atomic is true and
+-- some receiver is rejected nothing is stored and the receivers that would
+-- have been delivered are marked as aborted.
+-- The message starts a new thread if thread_id is nil, it never expires if
+-- expires_at is nil.
+-- Returns the id of the message (nil if aborted) and the outcomes.
+local function deliver(content, sender, receivers, atomic, thread_id, in_reply_to, expires_at)
+    -- The time of the messages grows with their ids, even if the clock goes
+    -- back
+    local created = math.max(fiber.time(), last_created)
+    last_created = created
+    local message = box.space.messages:insert{box.NULL, content, sender,
+                                               thread_id or box.NULL, in_reply_to or box.NULL, created,
+                                               expires_at or box.NULL}
+    local id = message[1]
+    if thread_id == nil then
+        thread_id = id
+        box.space.messages:update(id, {{'=', 4, id}})
+    end
+    touch_thread(sender, thread_id, id, 0)
+    local outcomes = {}
+    local seen = {}
+    local rejected = false
+    for i, receiver in ipairs(receivers) do
+        local status
+        if type(receiver) ~= 'string' or receiver == '' then
+            status = 'rejected'
+        elseif seen[receiver] then
+            status = 'duplicate'
+        else
+            seen[receiver] = true
+            local ok = pcall(box.space.receivers.insert, box.space.receivers,
+                             {id, receiver, false})
+            status = ok and 'delivered' or 'rejected'
+            if ok then
+                touch_thread(receiver, thread_id, id, 1)
+                notify(receiver, 'message', {message_id = id, sender = sender, thread_id = thread_id})
+            end
+        end
+        rejected = rejected or status == 'rejected'
+        outcomes[i] = {receiver = receiver, status = status}
+    end
+    if atomic and rejected then
+        for _, outcome in ipairs(outcomes) do
+            if outcome.status == 'delivered' then
+                outcome.status = 'aborted'
+            end
+        end
+        return box.NULL, outcomes
+    end
+    return id, outcomes
+end
+
+local function send(content, sender, receivers, atomic, thread_id, in_reply_to, expires_at)
+    box.begin()
+    local ok, id, outcomes = pcall(deliver, content, sender, receivers, atomic, thread_id, in_reply_to,
+                                   expires_at)
+    if not ok then
+        box.rollback()
+        error(id)
+    end
+    if id == nil then
+        box.rollback()
+    else
+        box.commit()
+    end
+    return id, outcomes
+end
+
+-- Returns whether agent can see the message m, as its sender or one of its
+-- receivers, and whether it has read it
+local function visible(m, agent)
+    if m[3] == agent then
+        return true, true
+    end
+    local r = box.space.receivers:get({m[1], agent})
+    if r == nil then
+        return false, false
+    end
+    return true, r[3]
+end
+
+-- Returns the thread of the message id, if agent can see it
+local function message_thread(id, agent)
+    local m = box.space.messages:get(id)
+    if m == nil or not alive(m) or not visible(m, agent) then
+        return box.NULL
+    end
+    return m[4]
+end
+
+-- After the message id is removed, or agent cannot see it anymore, the
+-- newest message of the thread that agent can still see becomes its latest
+-- one. The state is removed if there is none.
+local function refresh_thread(agent, thread_id, id)
+    local t = box.space.agent_threads:get({agent, thread_id})
+    if t == nil or t[3] ~= id then
+        return
+    end
+    for _, m in box.space.messages.index.thread:pairs({thread_id, id}, {iterator = 'LE'}) do
+        if m[4] ~= thread_id then
+            break
+        end
+        if visible(m, agent) then
+            box.space.agent_threads:update({agent, thread_id}, {{'=', 3, m[1]}})
+            return
+        end
+    end
+    box.space.agent_threads:delete({agent, thread_id})
+end
+
+-- Returns the newest message of the thread, up to id, that agent can see and
+-- that has not expired
+local function latest_alive(agent, thread_id, id)
+    for _, m in box.space.messages.index.thread:pairs({thread_id, id}, {iterator = 'LE'}) do
+        if m[4] ~= thread_id then
+            break
+        end
+        if alive(m) and visible(m, agent) then
+            return m
+        end
+    end
+    return nil
+end
+
+-- Returns up to limit threads of agent (the ones with a message it has sent
+-- or received), the one with the newest message first, whose newest message
+-- is older than cursor (if not nil). For each thread there are the newest
+-- message and the number of the unread ones, read from agent_threads so that
+-- only the threads of the page are visited. The expired messages are counted
+-- until expire removes them.
+local function threads(agent, cursor, limit)
+    local key, iterator = {agent}, 'REQ'
+    if cursor ~= nil then
+        key, iterator = {agent, cursor}, 'LT'
+    end
+    local page = {}
+    local next_cursor = box.NULL
+    local last = box.NULL
+    for _, t in box.space.agent_threads.index.latest:pairs(key, {iterator = iterator}) do
+        if t[1] ~= agent then
+            break
+        end
+        if #page == limit then
+            next_cursor = last
+            break
+        end
+        local m = latest_alive(agent, t[2], t[3])
+        if m ~= nil then
+            local _, read = visible(m, agent)
+            table.insert(page, {
+                thread_id = t[2],
+                unread = t[4],
+                latest = message_of(m, read),
+            })
+            last = t[3]
+        end
+    end
+    return page, next_cursor
+end
+
+-- Returns up to limit messages of the thread that agent can see, the oldest
+-- first, newer than cursor (if not nil)
+local function thread(agent, thread_id, cursor, limit)
+    local key = {thread_id}
+    local iterator = 'EQ'
+    if cursor ~= nil then
+        table.insert(key, cursor)
+        iterator = 'GT'
+    end
+    local messages = {}
+    local next_cursor = box.NULL
+    for _, m in box.space.messages.index.thread:pairs(key, {iterator = iterator}) do
+        if m[4] ~= thread_id then
+            break
+        end
+        local can_see, read = visible(m, agent)
+        if can_see and alive(m) then
+            if #messages == limit then
+                next_cursor = messages[#messages].id
+                break
+            end
+            table.insert(messages, message_of(m, read))
+        end
+    end
+    return messages, next_cursor
+end
+
+-- Sets the read flag of a message and records the change in the events
+local function set_read(receiver, message_id, read)
+    box.begin()
+    local ok, err = pcall(function()
+        local r = box.space.receivers:get({message_id, receiver})
+        if r == nil then
+            return
+        end
+        if r[3] ~= read then
+            box.space.receivers:update({message_id, receiver}, {{'=', 3, read}})
+            local m = box.space.messages:get(message_id)
+            if m ~= nil then
+                add_unread(receiver, m[4], read and -1 or 1)
+            end
+        end
+        notify(receiver, 'read', {message_id = message_id, read = read})
+    end)
+    if not ok then
+        box.rollback()
+        error(err)
+    end
+    box.commit()
+end
+
+-- Deletes the message with its receivers and updates the state of their
+-- threads, the transaction must be open
+local function remove_message(id)
+    local m = box.space.messages:get(id)
+    local receivers = {}
+    for _, r in box.space.receivers.index.primary:pairs({id}) do
+        table.insert(receivers, r)
+    end
+    for _, r in ipairs(receivers) do
+        box.space.receivers:delete({r[1], r[2]})
+    end
+    box.space.messages:delete(id)
+    if m == nil then
+        return
+    end
+    for _, r in ipairs(receivers) do
+        if not r[3] then
+            add_unread(r[2], m[4], -1)
+        end
+        refresh_thread(r[2], m[4], id)
+    end
+    refresh_thread(m[3], m[4], id)
+end
+
+-- Removes the message from the inbox of receiver, the message itself is
+-- deleted once no receiver has it
+local function delete(receiver, message_id)
+    box.begin()
+    local ok, err = pcall(function()
+        local r = box.space.receivers:get({message_id, receiver})
+        local m = box.space.messages:get(message_id)
+        box.space.receivers:delete({message_id, receiver})
+        if r ~= nil and m ~= nil then
+            if not r[3] then
+                add_unread(receiver, m[4], -1)
+            end
+            refresh_thread(receiver, m[4], message_id)
+        end
+        if box.space.receivers.index.primary:count({message_id}) == 0 then
+            remove_message(message_id)
+        end
+    end)
+    if not ok then
+        box.rollback()
+        error(err)
+    end
+    box.commit()
+end
+
+-- Deletes with their receivers up to limit messages that have expired
+-- before now or, if created_before is not nil, that were created before it.
+-- Returns the number of the deleted messages.
+local function expire(now, created_before, limit)
+    local expired = {}
+    local seen = {}
+    -- The messages without a time (null) come first, they are skipped
+    for _, m in box.space.messages.index.expires:pairs({0}, {iterator = 'GE'}) do
+        if m[7] > now or #expired == limit then
+            break
+        end
+        table.insert(expired, m[1])
+        seen[m[1]] = true
+    end
+    if created_before ~= nil then
+        for _, m in box.space.messages.index.created:pairs({0}, {iterator = 'GE'}) do
+            if m[6] >= created_before or #expired == limit then
+                break
+            end
+            if not seen[m[1]] then
+                table.insert(expired, m[1])
+            end
+        end
+    end
+
+    box.begin()
+    local ok, err = pcall(function()
+        for _, id in ipairs(expired) do
+            remove_message(id)
+        end
+    end)
+    if not ok then
+        box.rollback()
+        error(err)
+    end
+    box.commit()
+    return #expired
+end
+
+-- Deletes the events older than EVENTS_TTL
+local function prune_events()
+    local deadline = fiber.time() - EVENTS_TTL
+    local expired = {}
+    for _, e in box.space.events:pairs() do
+        if e[5] >= deadline then
+            break
+        end
+        table.insert(expired, e[1])
+    end
+    for _, id in ipairs(expired) do
+        box.space.events:delete(id)
+    end
+end
+
+-- Deletes the nonces of the signed requests that have expired
+local function prune_nonces()
+    local expired = {}
+    for _, n in box.space.nonces.index.expires:pairs({fiber.time()}, {iterator = 'LT'}) do
+        table.insert(expired, {n[1], n[2]})
+    end
+    for _, key in ipairs(expired) do
+        box.space.nonces:delete(key)
+    end
+end
+
+-- Marks as taken for lease seconds (the time of the next attempt is moved
+-- forward) up to limit pending deliveries whose next attempt is due, so that
+-- other instances of the service do not take them too
+local function claim_deliveries(now, limit, lease)
+    box.begin()
+    local ok, claimed = pcall(function()
+        local due = {}
+        for _, d in box.space.deliveries.index.due:pairs({'pending'}, {iterator = 'GE'}) do
+            if d[6] ~= 'pending' or d[8] > now or #due == limit then
+                break
+            end
+            table.insert(due, d[1])
+        end
+        local claimed = {}
+        for _, id in ipairs(due) do
+            table.insert(claimed, box.space.deliveries:update(id, {{'=', 8, now + lease}}))
+        end
+        return claimed
+    end)
+    if not ok then
+        box.rollback()
+        error(claimed)
+    end
+    box.commit()
+    return claimed
+end
+
+-- Deletes the deliveries completed since more than DELIVERIES_TTL
+local function prune_deliveries()
+    local deadline = fiber.time() - DELIVERIES_TTL
+    local expired = {}
+    for _, d in box.space.deliveries.index.due:pairs({'delivered'}, {iterator = 'GE'}) do
+        if d[6] ~= 'delivered' or d[8] >= deadline then
+            break
+        end
+        table.insert(expired, d[1])
+    end
+    for _, id in ipairs(expired) do
+        box.space.deliveries:delete(id)
+    end
+end
+
+-- Reserves the id of an activity posted to an outbox, so that the id can be
+-- part of the activity
+local function next_activity_id()
+    return box.sequence.activity_id:next()
+end
+
+-- Returns up to limit activities of owner in index (ordered by owner and
+-- id), the newest first, older than before (if not nil), and the number of
+-- activities of owner
+local function activity_page(index, owner, before, limit)
+    local key = {owner}
+    local iterator = 'REQ'
+    if before ~= nil then
+        table.insert(key, before)
+        iterator = 'LT'
+    end
+    local activities = {}
+    for _, a in index:pairs(key, {iterator = iterator}) do
+        if a[2] ~= owner or #activities == limit then
+            break
+        end
+        table.insert(activities, a)
+    end
+    return activities, index:count({owner})
+end
+
+-- Page of the outbox of actor
+local function outbox(actor, before, limit)
+    return activity_page(box.space.activities.index.actor, actor, before, limit)
+end
+
+-- Page of the activities received by receiver
+local function received(receiver, before, limit)
+    return activity_page(box.space.received.index.receiver, receiver, before, limit)
+end
+
+-- Returns up to limit likes of object, the oldest first, and the number of
+-- its likes
+local function object_likes(object, limit)
+    local index = box.space.liked.index.objects
+    return index:select({object}, {limit = limit}), index:count({object})
+end
+
+-- Returns the number of the accepted followers of actor or, if follower is
+-- true, of the actors it follows
+local function count_follows(actor, follower)
+    if follower then
+        return box.space.follow.index.follower:count({actor, true})
+    end
+    local count = 0
+    for _, f in box.space.follow.index.following:pairs({actor}) do
+        if f[4] then
+            count = count + 1
+        end
+    end
+    return count
+end
+
+local function housekeeping()
+    while true do
+        fiber.sleep(60)
+        if not box.info.ro then
+            local ok, err = pcall(prune_events)
+            if not ok then
+                log.error('Could not prune events: %s', err)
+            end
+            ok, err = pcall(prune_nonces)
+            if not ok then
+                log.error('Could not prune nonces: %s', err)
+            end
+            ok, err = pcall(prune_deliveries)
+            if not ok then
+                log.error('Could not prune deliveries: %s', err)
+            end
+        end
+    end
+end
+
 local function start()
+    local newest = box.space.messages.index.primary:max()
+    if newest ~= nil and newest[6] ~= nil then
+        last_created = newest[6]
+    end
+    rawset(_G, 'inbox_read', read)
+    rawset(_G, 'inbox_count_unread', count_unread)
+    rawset(_G, 'inbox_send', send)
+    rawset(_G, 'inbox_set_read', set_read)
+    rawset(_G, 'inbox_claim_deliveries', claim_deliveries)
+    rawset(_G, 'inbox_next_activity_id', next_activity_id)
+    rawset(_G, 'inbox_outbox', outbox)
+    rawset(_G, 'inbox_received', received)
+    rawset(_G, 'inbox_object_likes', object_likes)
+    rawset(_G, 'inbox_count_follows', count_follows)
+    rawset(_G, 'inbox_message_thread', message_thread)
+    rawset(_G, 'inbox_threads', threads)
+    rawset(_G, 'inbox_thread', thread)
+    rawset(_G, 'inbox_delete', delete)
+    rawset(_G, 'inbox_expire', expire)
+    fiber.create(housekeeping)
 end
 
 return {
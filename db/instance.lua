@@ -69,6 +69,409 @@ local function bootstrap()
 end
 box.once('inbox-00', bootstrap)
 
+-- Indexes used by the paginated read, the messages of a receiver are
+-- iterated by message id
+local function paginated_read()
+    local receivers = box.space.receivers
+    receivers:create_index('receiver_messages', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 1, type = 'unsigned'},
+    }})
+    receivers:create_index('receiver_unread', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 3, type = 'boolean'},
+        {field = 1, type = 'unsigned'},
+    }})
+end
+box.once('inbox-01', paginated_read)
+
+-- Stored procedures defined in inbox.lua
+local function stored_procedures()
+    box.schema.func.create('inbox_read', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_read', {if_not_exists = true})
+end
+box.once('inbox-02', stored_procedures)
+
+local function atomic_send()
+    box.schema.func.create('inbox_send', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_send', {if_not_exists = true})
+end
+box.once('inbox-03', atomic_send)
+
+-- Events pushed to the subscribers, they are shared by all the instances of
+-- the service
+local function events()
+    box.schema.sequence.create('event_id',{start=1,min=1,step=1})
+    local events = box.schema.create_space('events', {engine = 'vinyl'})
+    events:format({
+        {name='event_id', type='unsigned', is_nullable=false},
+        {name='receiver', type='string', is_nullable=false},
+        {name='type', type='string', is_nullable=false},
+        {name='data', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+    })
+    events:create_index('primary', {sequence='event_id'})
+    events:create_index('receiver', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 1, type = 'unsigned'},
+    }})
+
+    box.schema.func.create('inbox_set_read', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_set_read', {if_not_exists = true})
+end
+box.once('inbox-04', events)
+
+-- Nonces of the signed requests, they are removed after expires
+local function nonces()
+    local nonces = box.schema.create_space('nonces', {engine = 'vinyl'})
+    nonces:format({
+        {name='agent', type='string', is_nullable=false},
+        {name='nonce', type='string', is_nullable=false},
+        {name='expires', type='number', is_nullable=false},
+    })
+    nonces:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'string'},
+        {field = 2, type = 'string'},
+    }})
+    nonces:create_index('expires', { unique=false, parts = {
+        {field = 3, type = 'number'},
+    }})
+end
+box.once('inbox-05', nonces)
+
+-- Private keys (PEM) used to sign the activities of the local actors
+local function actor_keys()
+    local actor_keys = box.schema.create_space('actor_keys', {engine = 'vinyl'})
+    actor_keys:format({
+        {name='actor', type='string', is_nullable=false},
+        {name='private_key', type='string', is_nullable=false},
+    })
+    actor_keys:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'string'},
+    }})
+end
+box.once('inbox-06', actor_keys)
+
+-- Queue of the activities to deliver to other servers
+local function deliveries()
+    box.schema.sequence.create('delivery_id',{start=1,min=1,step=1})
+    local deliveries = box.schema.create_space('deliveries', {engine = 'vinyl'})
+    deliveries:format({
+        {name='delivery_id', type='unsigned', is_nullable=false},
+        {name='actor', type='string', is_nullable=false},
+        {name='target', type='string', is_nullable=false},
+        {name='host', type='string', is_nullable=false},
+        {name='activity', type='string', is_nullable=false},
+        -- pending, delivered, dead or held
+        {name='status', type='string', is_nullable=false},
+        {name='attempts', type='unsigned', is_nullable=false},
+        {name='next_attempt', type='number', is_nullable=false},
+        {name='last_error', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+    })
+    deliveries:create_index('primary', {sequence='delivery_id'})
+    deliveries:create_index('due', { unique=false, parts = {
+        {field = 6, type = 'string'},
+        {field = 8, type = 'number'},
+    }})
+
+    box.schema.func.create('inbox_claim_deliveries', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_claim_deliveries', {if_not_exists = true})
+end
+box.once('inbox-07', deliveries)
+
+-- A follow request is pending until it is accepted or rejected, the id of
+-- the Follow activity is kept to answer it later. The policy of an actor
+-- tells what to do with the requests it receives (auto, manual or deny).
+local function follow_policies()
+    local follow = box.space.follow
+    -- accepted used to be appended as a fifth field instead of being set
+    local broken = {}
+    for _, t in follow:pairs() do
+        if #t > 4 then
+            table.insert(broken, t)
+        end
+    end
+    for _, t in ipairs(broken) do
+        follow:update(t[1], {{'=', 4, t[#t]}, {'#', 5, #t - 4}})
+    end
+    follow:format({
+        {name='follow_id', type='unsigned',is_nullable=false},
+        {name='follower', type='string',is_nullable=false},
+        {name="following", type='string', is_nullable=false},
+        {name="accepted", type='boolean', is_nullable=false},
+        {name="rejected", type='boolean', is_nullable=true},
+        {name="activity", type='string', is_nullable=true},
+    })
+
+    local follow_policies = box.schema.create_space('follow_policies', {engine = 'vinyl'})
+    follow_policies:format({
+        {name='actor', type='string', is_nullable=false},
+        {name='policy', type='string', is_nullable=false},
+    })
+    follow_policies:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'string'},
+    }})
+end
+box.once('inbox-08', follow_policies)
+
+-- Activities posted to the outboxes
+local function activities()
+    box.schema.sequence.create('activity_id',{start=1,min=1,step=1})
+    local activities = box.schema.create_space('activities', {engine = 'vinyl'})
+    activities:format({
+        {name='activity_id', type='unsigned', is_nullable=false},
+        {name='actor', type='string', is_nullable=false},
+        {name='type', type='string', is_nullable=false},
+        {name='activity', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+    })
+    activities:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'unsigned'},
+    }})
+    activities:create_index('actor', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 1, type = 'unsigned'},
+    }})
+
+    box.schema.func.create('inbox_next_activity_id', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_next_activity_id', {if_not_exists = true})
+    box.schema.func.create('inbox_outbox', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_outbox', {if_not_exists = true})
+end
+box.once('inbox-09', activities)
+
+-- Activities received by the inboxes of the local actors
+local function received()
+    box.schema.sequence.create('received_id',{start=1,min=1,step=1})
+    local received = box.schema.create_space('received', {engine = 'vinyl'})
+    received:format({
+        {name='received_id', type='unsigned', is_nullable=false},
+        {name='receiver', type='string', is_nullable=false},
+        {name='type', type='string', is_nullable=false},
+        {name='activity', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+    })
+    received:create_index('primary', {sequence='received_id'})
+    received:create_index('receiver', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 1, type = 'unsigned'},
+    }})
+
+    box.schema.func.create('inbox_received', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_received', {if_not_exists = true})
+end
+box.once('inbox-10', received)
+
+-- The likes received from other servers keep the id of their activity, the
+-- likes of an object are counted by inbox_object_likes
+local function likes()
+    local liked = box.space.liked
+    liked:format({
+        {name='liked_id', type='unsigned',is_nullable=false},
+        {name='actor_id', type='string',is_nullable=false},
+        {name="object", type='string', is_nullable=false},
+        {name="summary", type='string'},
+        {name="activity", type='string', is_nullable=true},
+    })
+    liked:create_index('object_actor', { unique=false, parts = {
+        {field = 3, type = 'string'},
+        {field = 2, type = 'string'},
+    }})
+
+    box.schema.func.create('inbox_object_likes', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_object_likes', {if_not_exists = true})
+    box.schema.func.create('inbox_count_follows', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_count_follows', {if_not_exists = true})
+end
+box.once('inbox-11', likes)
+
+-- Messages are grouped in threads, the id of a thread is the id of its first
+-- message. The existing messages start a thread each.
+local function threads()
+    local messages = box.space.messages
+    messages:format({
+        {name='pk', type='unsigned', is_nullable=false},
+        {name='message', type='string', is_nullable=false},
+        {name='sender', type='string', is_nullable=false},
+        {name='thread_id', type='unsigned', is_nullable=true},
+        {name='in_reply_to', type='unsigned', is_nullable=true},
+    })
+    local ids = {}
+    for _, m in messages:pairs() do
+        table.insert(ids, m[1])
+    end
+    for _, id in ipairs(ids) do
+        messages:update(id, {{'=', 4, id}})
+    end
+    messages:create_index('thread', { unique=true, parts = {
+        {field = 4, type = 'unsigned', is_nullable = true},
+        {field = 1, type = 'unsigned'},
+    }})
+    messages:create_index('sender', { unique=true, parts = {
+        {field = 3, type = 'string'},
+        {field = 1, type = 'unsigned'},
+    }})
+
+    for _, name in ipairs({'inbox_message_thread', 'inbox_threads', 'inbox_thread'}) do
+        box.schema.func.create(name, {if_not_exists = true})
+        box.schema.user.grant('inbox', 'execute', 'function', name, {if_not_exists = true})
+    end
+end
+box.once('inbox-12', threads)
+
+-- Messages are stamped with the time they are stored (seconds since the
+-- epoch), which grows with their ids. The time of the existing messages is
+-- not known, they get the time of the migration.
+local function message_time()
+    local messages = box.space.messages
+    messages:format({
+        {name='pk', type='unsigned', is_nullable=false},
+        {name='message', type='string', is_nullable=false},
+        {name='sender', type='string', is_nullable=false},
+        {name='thread_id', type='unsigned', is_nullable=true},
+        {name='in_reply_to', type='unsigned', is_nullable=true},
+        {name='created', type='number', is_nullable=true},
+    })
+    local now = require('fiber').time()
+    local ids = {}
+    for _, m in messages:pairs() do
+        table.insert(ids, m[1])
+    end
+    for _, id in ipairs(ids) do
+        messages:update(id, {{'=', 6, now}})
+    end
+    messages:create_index('created', { unique=true, parts = {
+        {field = 6, type = 'number', is_nullable = true},
+        {field = 1, type = 'unsigned'},
+    }})
+end
+box.once('inbox-13', message_time)
+
+-- Messages can expire (seconds since the epoch, null if they never do) and
+-- are deleted once no receiver has them. The messages that were already
+-- deleted by all their receivers are removed.
+local function expiry()
+    local messages = box.space.messages
+    messages:format({
+        {name='pk', type='unsigned', is_nullable=false},
+        {name='message', type='string', is_nullable=false},
+        {name='sender', type='string', is_nullable=false},
+        {name='thread_id', type='unsigned', is_nullable=true},
+        {name='in_reply_to', type='unsigned', is_nullable=true},
+        {name='created', type='number', is_nullable=true},
+        {name='expires_at', type='number', is_nullable=true},
+    })
+    messages:create_index('expires', { unique=true, parts = {
+        {field = 7, type = 'number', is_nullable = true},
+        {field = 1, type = 'unsigned'},
+    }})
+    local orphans = {}
+    for _, m in messages:pairs() do
+        if box.space.receivers.index.primary:count({m[1]}) == 0 then
+            table.insert(orphans, m[1])
+        end
+    end
+    for _, id in ipairs(orphans) do
+        messages:delete(id)
+    end
+
+    for _, name in ipairs({'inbox_delete', 'inbox_expire'}) do
+        box.schema.func.create(name, {if_not_exists = true})
+        box.schema.user.grant('inbox', 'execute', 'function', name, {if_not_exists = true})
+    end
+end
+box.once('inbox-14', expiry)
+
+-- Direct notes of the messages sent to actors on other servers, they share
+-- the ids of the activities and are served only to their audience
+local function direct_activities()
+    local direct = box.schema.create_space('direct_activities', {engine = 'vinyl'})
+    direct:format({
+        {name='activity_id', type='unsigned', is_nullable=false},
+        {name='actor', type='string', is_nullable=false},
+        {name='type', type='string', is_nullable=false},
+        {name='activity', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+        {name='audience', type='array', is_nullable=false},
+    })
+    direct:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'unsigned'},
+    }})
+end
+box.once('inbox-15', direct_activities)
+
+-- The unread messages are counted by a procedure, which skips the expired
+-- ones
+local function count_unread()
+    box.schema.func.create('inbox_count_unread', {if_not_exists = true})
+    box.schema.user.grant('inbox', 'execute', 'function', 'inbox_count_unread', {if_not_exists = true})
+end
+box.once('inbox-16', count_unread)
+
+-- For each agent and each of its threads, the newest message and the number
+-- of the unread ones, kept up to date by the procedures. It is built from
+-- the existing messages.
+local function thread_state()
+    local agent_threads = box.schema.create_space('agent_threads', {engine = 'vinyl'})
+    agent_threads:format({
+        {name='agent', type='string', is_nullable=false},
+        {name='thread_id', type='unsigned', is_nullable=false},
+        {name='latest', type='unsigned', is_nullable=false},
+        {name='unread', type='unsigned', is_nullable=false},
+    })
+    agent_threads:create_index('primary', { unique=true, parts = {
+        {field = 1, type = 'string'},
+        {field = 2, type = 'unsigned'},
+    }})
+    agent_threads:create_index('latest', { unique=true, parts = {
+        {field = 1, type = 'string'},
+        {field = 3, type = 'unsigned'},
+    }})
+
+    local state = {}
+    local function touch(agent, thread_id, id, unread)
+        local key = agent .. '\0' .. thread_id
+        local t = state[key]
+        if t == nil then
+            state[key] = {agent, thread_id, id, unread}
+        else
+            t[3] = math.max(t[3], id)
+            t[4] = t[4] + unread
+        end
+    end
+    for _, m in box.space.messages:pairs() do
+        touch(m[3], m[4], m[1], 0)
+        for _, r in box.space.receivers.index.primary:pairs({m[1]}) do
+            touch(r[2], m[4], m[1], r[3] and 0 or 1)
+        end
+    end
+    for _, t in pairs(state) do
+        agent_threads:insert(t)
+    end
+end
+box.once('inbox-17', thread_state)
+
+-- The received activities keep their id, so that an activity delivered
+-- again (e.g. retried after a timeout) is recognized. The activities
+-- without an id, and the ones received before, have null.
+local function received_ids()
+    local received = box.space.received
+    received:format({
+        {name='received_id', type='unsigned', is_nullable=false},
+        {name='receiver', type='string', is_nullable=false},
+        {name='type', type='string', is_nullable=false},
+        {name='activity', type='string', is_nullable=false},
+        {name='created', type='number', is_nullable=false},
+        {name='activity_id', type='string', is_nullable=true},
+    })
+    received:create_index('activity_id', { unique=true, parts = {
+        {field = 2, type = 'string'},
+        {field = 6, type = 'string', is_nullable = true},
+    }})
+end
+box.once('inbox-18', received_ids)
+
 -- load my_app module and call start() function
 -- with some app options controlled by sysadmins
 local m = require('inbox').start()
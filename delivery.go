@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// An activity waiting to be delivered to a remote inbox
+type QueuedDelivery struct {
+	Id uint64 `json:"id"`
+	// Local actor that signs the request
+	Actor       string    `json:"actor"`
+	Target      string    `json:"target"`
+	Host        string    `json:"host"`
+	Activity    string    `json:"activity"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+	Created     time.Time `json:"created"`
+}
+
+// Once done a delivery is DELIVERY_DELIVERED, as the outcome of a message
+const (
+	DELIVERY_PENDING = "pending"
+	// Failed too many times (or refused by the remote server), it is retried
+	// only on request of an admin
+	DELIVERY_DEAD = "dead"
+	// Not attempted until it is released, e.g. until the message it carries
+	// is stored for the local receivers too
+	DELIVERY_HELD = "held"
+)
+
+var ErrDeliveryNotFound = errors.New("Delivery not found")
+
+const (
+	DELIVERY_MIN_BACKOFF = 30 * time.Second
+	DELIVERY_MAX_BACKOFF = 6 * time.Hour
+	// A claimed delivery is not taken by other workers for this long
+	DELIVERY_LEASE = 5 * time.Minute
+)
+
+// Delivers the queued activities in background, the queue is in the storage
+// so that it survives restarts and it is shared by all the instances
+type DeliveryQueue struct {
+	storage     Storage
+	keys        *KeyRing
+	maxAttempts int
+
+	workers chan struct{}
+	hosts   *hostLimiter
+	wake    chan struct{}
+}
+
+func NewDeliveryQueue(storage Storage, keys *KeyRing, workers, perHost, maxAttempts int) *DeliveryQueue {
+	return &DeliveryQueue{
+		storage:     storage,
+		keys:        keys,
+		maxAttempts: maxAttempts,
+		workers:     make(chan struct{}, workers),
+		hosts:       newHostLimiter(perHost),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Stores the activity, it will be posted to target signed by actor
+func (queue *DeliveryQueue) enqueue(actor, target string, activity []byte) (uint64, error) {
+	return queue.store(actor, target, activity, DELIVERY_PENDING)
+}
+
+func (queue *DeliveryQueue) store(actor, target string, activity []byte, status string) (uint64, error) {
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	id, err := queue.storage.enqueueDelivery(QueuedDelivery{
+		Actor:       actor,
+		Target:      target,
+		Host:        targetUrl.Host,
+		Activity:    string(activity),
+		Status:      status,
+		NextAttempt: now,
+		Created:     now,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if status == DELIVERY_PENDING {
+		queue.notify()
+	}
+	return id, nil
+}
+
+// Wakes up the queue, if it is waiting
+func (queue *DeliveryQueue) notify() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Queues the activity for each follower of actor
+func (queue *DeliveryQueue) toFollowers(actor string, activity []byte) ([]uint64, error) {
+	followers, err := queue.storage.findActorFollows(actor, false)
+	if err != nil {
+		return nil, err
+	}
+	return queue.fanOut(actor, followers, activity, true)
+}
+
+// Queues the activity for each recipient. If shared, the recipients that
+// share an inbox (usually those on the same server) get it only once,
+// otherwise it is posted to the inbox of each of them.
+func (queue *DeliveryQueue) fanOut(actor string, recipients []string, activity []byte, shared bool) ([]uint64, error) {
+	return queue.fanOutWith(actor, recipients, activity, shared, DELIVERY_PENDING)
+}
+
+// As fanOut, the deliveries are held until they are released. On failure
+// the deliveries queued so far are returned too, to be canceled.
+func (queue *DeliveryQueue) hold(actor string, recipients []string, activity []byte) ([]uint64, error) {
+	return queue.fanOutWith(actor, recipients, activity, true, DELIVERY_HELD)
+}
+
+func (queue *DeliveryQueue) fanOutWith(actor string, recipients []string, activity []byte, shared bool, status string) ([]uint64, error) {
+	targets := make(map[string]bool)
+	ids := []uint64{}
+	for _, recipient := range recipients {
+		target, err := queue.keys.actorInbox(recipient)
+		if shared {
+			target, err = queue.keys.deliveryInbox(recipient)
+		}
+		if err != nil {
+			log.Printf("[APUB] No inbox for %s: %s\n", recipient, err.Error())
+			target = fmt.Sprintf("%s/inbox", recipient)
+		}
+		if targets[target] {
+			continue
+		}
+		targets[target] = true
+		id, err := queue.store(actor, target, activity, status)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Puts the held deliveries in the queue
+func (queue *DeliveryQueue) release(ids []uint64) error {
+	for _, id := range ids {
+		if err := queue.storage.retryDelivery(id); err != nil {
+			return err
+		}
+	}
+	queue.notify()
+	return nil
+}
+
+// Removes the held deliveries, they are not attempted
+func (queue *DeliveryQueue) cancel(ids []uint64) {
+	for _, id := range ids {
+		if err := queue.storage.removeDelivery(id); err != nil {
+			log.Printf("Could not cancel delivery %d: %s\n", id, err.Error())
+		}
+	}
+}
+
+func backoff(attempts int) time.Duration {
+	delay := DELIVERY_MIN_BACKOFF
+	for i := 1; i < attempts && delay < DELIVERY_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > DELIVERY_MAX_BACKOFF {
+		delay = DELIVERY_MAX_BACKOFF
+	}
+	return delay
+}
+
+// Posts the activity, returns whether the failure is permanent
+func (queue *DeliveryQueue) attempt(delivery QueuedDelivery) (bool, error) {
+	resp, err := queue.keys.post(delivery.Actor, delivery.Target, []byte(delivery.Activity))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("Status %d: %s", resp.StatusCode, string(body))
+	// The remote server refused the activity, retrying would not help
+	permanent := resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != 408 && resp.StatusCode != 429
+	return permanent, err
+}
+
+func (queue *DeliveryQueue) process(delivery QueuedDelivery) {
+	queue.hosts.acquire(delivery.Host)
+	defer queue.hosts.release(delivery.Host)
+
+	permanent, err := queue.attempt(delivery)
+	if err == nil {
+		log.Printf("[APUB] Delivered %d to %s\n", delivery.Id, delivery.Target)
+		if err := queue.storage.deliverySucceeded(delivery.Id); err != nil {
+			log.Println("Could not update delivery:", err.Error())
+		}
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	dead := permanent || attempts >= queue.maxAttempts
+	log.Printf("[APUB] Delivery %d to %s failed (attempt %d): %s\n",
+		delivery.Id, delivery.Target, attempts, err.Error())
+	if err := queue.storage.deliveryFailed(delivery.Id, err.Error(), time.Now().Add(backoff(attempts)), dead); err != nil {
+		log.Println("Could not update delivery:", err.Error())
+		return
+	}
+	if dead {
+		queue.dead(delivery)
+	}
+}
+
+// Undoes the local effects of an activity that could not be delivered
+func (queue *DeliveryQueue) dead(delivery QueuedDelivery) {
+	var activity Activity
+	if err := json.Unmarshal([]byte(delivery.Activity), &activity); err != nil {
+		return
+	}
+	switch activity.Type {
+	case "Follow":
+		log.Printf("[APUB] Follow of %s by %s not delivered, removing it\n", activity.Object, activity.Actor)
+		if _, err := queue.storage.removeFollower(activity.Actor, activity.Object); err != nil {
+			log.Println("Could not remove follow:", err.Error())
+		}
+	}
+}
+
+// Claims the due deliveries, as many as the free workers, and processes
+// them in background
+func (queue *DeliveryQueue) poll() error {
+	free := cap(queue.workers) - len(queue.workers)
+	if free == 0 {
+		return nil
+	}
+	claimed, err := queue.storage.claimDeliveries(time.Now(), free, DELIVERY_LEASE)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range claimed {
+		queue.workers <- struct{}{}
+		go func(delivery QueuedDelivery) {
+			defer func() { <-queue.workers }()
+			queue.process(delivery)
+		}(delivery)
+	}
+	return nil
+}
+
+// Polls the queue forever, it has to be run in its own goroutine
+func (queue *DeliveryQueue) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := queue.poll(); err != nil {
+			log.Println("Could not read the deliveries:", err.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-queue.wake:
+		}
+	}
+}
+
+// Limits the concurrent deliveries to the same host
+type hostLimiter struct {
+	perHost int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(perHost int) *hostLimiter {
+	return &hostLimiter{
+		perHost: perHost,
+		slots:   make(map[string]chan struct{}),
+	}
+}
+
+func (limiter *hostLimiter) slot(host string) chan struct{} {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.slots[host] == nil {
+		limiter.slots[host] = make(chan struct{}, limiter.perHost)
+	}
+	return limiter.slots[host]
+}
+
+func (limiter *hostLimiter) acquire(host string) {
+	limiter.slot(host) <- struct{}{}
+}
+
+func (limiter *hostLimiter) release(host string) {
+	<-limiter.slot(host)
+}
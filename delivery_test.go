@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Makes every pending delivery due, without waiting for its backoff
+func (ti *testInbox) dueNow() {
+	ti.storage.mu.Lock()
+	defer ti.storage.mu.Unlock()
+	for id, delivery := range ti.storage.deliveries {
+		if delivery.Status == DELIVERY_PENDING {
+			delivery.NextAttempt = time.Now()
+			ti.storage.deliveries[id] = delivery
+		}
+	}
+}
+
+func (ti *testInbox) deliveries(t *testing.T, status string) []QueuedDelivery {
+	t.Helper()
+	deliveries, err := ti.storage.listDeliveries(status, LIMIT_MSG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestFollowDelivered(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2"
+
+	_, err := ti.client("P1").PostActivity("person", "P1", map[string]interface{}{"type": "Follow", "actor": p1, "object": p2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Follow reaches the inbox of P2, signed, and the Accept comes back
+	eventually(t, func() bool {
+		following, err := ti.storage.findActorFollows(p1, true)
+		return err == nil && len(following) == 1 && len(ti.deliveries(t, DELIVERY_DELIVERED)) == 2
+	})
+	followers, err := ti.storage.findActorFollows(p2, false)
+	if err != nil || len(followers) != 1 || followers[0] != p1 {
+		t.Fatal(followers, err)
+	}
+}
+
+func TestDeadDelivery(t *testing.T) {
+	ti := newTestInbox(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	p1 := ti.server.URL + "/person/P1"
+
+	_, err := ti.client("P1").PostActivity("person", "P1", map[string]interface{}{"type": "Follow", "actor": p1, "object": failing.URL + "/person/X"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The target gets the delivery once for each attempt, then it is dead
+	eventually(t, func() bool {
+		ti.dueNow()
+		return len(ti.deliveries(t, DELIVERY_DEAD)) == 1
+	})
+	dead := ti.deliveries(t, DELIVERY_DEAD)[0]
+	if dead.Attempts != 3 || dead.LastError == "" || dead.Target != failing.URL+"/person/X/inbox" {
+		t.Fatalf("Unexpected dead delivery %+v", dead)
+	}
+	// The follow is not kept if it could not be delivered
+	if following, err := ti.storage.findActorFollows(p1, true); err != nil || len(following) != 0 {
+		t.Fatal(following, err)
+	}
+
+	admin := map[string]string{"Authorization": "Bearer admin"}
+	status, result := ti.do(t, "GET", "/admin/deliveries", nil, admin)
+	if status != http.StatusOK || len(result["data"].([]interface{})) != 1 {
+		t.Fatal(status, result)
+	}
+	status, result = ti.do(t, "POST", "/admin/deliveries/99/retry", nil, admin)
+	if status != http.StatusNotFound || result["code"] != CODE_NOT_FOUND {
+		t.Fatal(status, result)
+	}
+	status, result = ti.do(t, "GET", "/admin/deliveries", nil, map[string]string{"Authorization": "Bearer nope"})
+	if status != http.StatusUnauthorized || result["code"] != CODE_UNAUTHORIZED {
+		t.Fatal(status, result)
+	}
+}
+
+func TestRetryDelivery(t *testing.T) {
+	ti := newTestInbox(t)
+	id, err := ti.storage.enqueueDelivery(QueuedDelivery{
+		Actor:       ti.server.URL + "/person/P1",
+		Target:      "http://127.0.0.1:1/inbox",
+		Host:        "127.0.0.1:1",
+		Activity:    "{}",
+		Status:      DELIVERY_PENDING,
+		NextAttempt: time.Now().Add(time.Hour),
+		Created:     time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ti.storage.deliveryFailed(id, "refused", time.Now(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	status, result := ti.do(t, "POST", "/admin/deliveries/"+strconv.FormatUint(id, 10)+"/retry", nil, map[string]string{"Authorization": "Bearer admin"})
+	if status != http.StatusOK || result["success"] != true {
+		t.Fatal(status, result)
+	}
+	// It is attempted again from scratch
+	eventually(t, func() bool {
+		deliveries := ti.deliveries(t, "")
+		return len(deliveries) == 1 && deliveries[0].Attempts >= 1 && deliveries[0].LastError != "refused"
+	})
+}
+
+// Storage that cannot queue the deliveries
+type failingQueueStorage struct {
+	*MemStorage
+}
+
+func (storage failingQueueStorage) enqueueDelivery(QueuedDelivery) (uint64, error) {
+	return 0, errors.New("Queue not available")
+}
+
+// Actor of another server, it accepts everything posted to its inbox
+func newTestRemoteActor(t *testing.T) string {
+	remote, _ := newTestRemote(t, func(url string, path string) map[string]interface{} {
+		return map[string]interface{}{"id": url + "/actor", "type": "Person", "inbox": url + "/actor/inbox"}
+	})
+	return remote.URL + "/actor"
+}
+
+func TestRemoteSend(t *testing.T) {
+	ti := newTestInbox(t)
+	actor := newTestRemoteActor(t)
+
+	sent, err := ti.client("alice").Send([]string{"bob", actor}, map[string]interface{}{"message": "hi"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Count != 2 || sent.Receivers[1].Status != DELIVERY_QUEUED {
+		t.Fatalf("Unexpected outcomes %+v", sent)
+	}
+	eventually(t, func() bool {
+		return len(ti.deliveries(t, DELIVERY_DELIVERED)) == 1
+	})
+}
+
+func TestAtomicRemoteSend(t *testing.T) {
+	ti := newTestInbox(t)
+	actor := newTestRemoteActor(t)
+
+	// A local receiver is rejected: the remote one does not get it either
+	sent, err := ti.client("alice").Send([]string{"bob", "", actor}, map[string]interface{}{"message": "hi"}, true)
+	expectCode(t, err, http.StatusUnprocessableEntity, CODE_SEND_ABORTED)
+	if sent != nil || len(ti.deliveries(t, "")) != 0 {
+		t.Fatal(sent, ti.deliveries(t, ""))
+	}
+	if page, err := ti.storage.read(ReadQuery{Receiver: "bob"}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+
+	// The message cannot be queued for the remote receiver: the local ones
+	// do not get it either
+	failing := failingQueueStorage{ti.storage}
+	ti.Inbox.storage = failing
+	ti.Inbox.deliveries = NewDeliveryQueue(failing, ti.keys, 4, 2, 3)
+	_, err = ti.client("alice").Send([]string{"bob", actor}, map[string]interface{}{"message": "hi"}, true)
+	expectCode(t, err, http.StatusInternalServerError, CODE_INTERNAL_ERROR)
+	if page, err := ti.storage.read(ReadQuery{Receiver: "bob"}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+
+	// Unless the send is not atomic
+	sent, err = ti.client("alice").Send([]string{"bob", actor}, map[string]interface{}{"message": "hi"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Count != 1 || sent.Receivers[0].Status != DELIVERY_DELIVERED || sent.Receivers[1].Status != DELIVERY_REJECTED {
+		t.Fatalf("Unexpected outcomes %+v", sent)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The messages sent with /send to actors on other servers are delivered as
+// direct notes: a Create of a Note addressed only to them, which carries the
+// content of the message as its JSON source. The notes received by a person
+// are turned back into messages.
+//
+// The thread and the message a note replies to are not served, they are
+// identified by the urls BASE_URL/thread/:id and BASE_URL/message/:id, its
+// expiry is the endTime of the note.
+
+const MESSAGE_MEDIA_TYPE = "application/json"
+
+// Splits the receivers in the ids of the zenflows agents and the urls of the
+// actors on other servers, the urls of the local persons are turned into ids
+func splitReceivers(receivers []string) ([]string, []string) {
+	local := []string{}
+	remote := []string{}
+	for _, receiver := range receivers {
+		if actorType, id, ok := localActor(receiver); ok && actorType == "person" {
+			local = append(local, id)
+		} else if strings.HasPrefix(receiver, "http://") || strings.HasPrefix(receiver, "https://") {
+			remote = append(remote, receiver)
+		} else {
+			local = append(local, receiver)
+		}
+	}
+	return local, remote
+}
+
+// Outcome of the remote receivers before the delivery, the second result
+// tells if some of them is rejected
+func remoteOutcomes(remote []string) ([]Delivery, bool) {
+	outcomes := []Delivery{}
+	seen := make(map[string]bool)
+	rejected := false
+	for _, receiver := range remote {
+		status := DELIVERY_QUEUED
+		if actorUrl, err := url.Parse(receiver); err != nil || actorUrl.Host == "" {
+			status = DELIVERY_REJECTED
+			rejected = true
+		} else if seen[receiver] {
+			status = DELIVERY_DUPLICATE
+		}
+		seen[receiver] = true
+		outcomes = append(outcomes, Delivery{receiver, status})
+	}
+	return outcomes, rejected
+}
+
+// Changes the outcome of the remote receivers that are still queued
+func setQueued(outcomes []Delivery, status string) {
+	for i := range outcomes {
+		if outcomes[i].Status == DELIVERY_QUEUED {
+			outcomes[i].Status = status
+		}
+	}
+}
+
+// Posts the content of a message as a direct note of its sender to the
+// remote receivers whose outcome is queued. The activity is not in the
+// outbox, which is public, it is served only to the receivers. The
+// deliveries are held, the caller has to release or cancel them, also on
+// failure.
+func (inbox *Inbox) sendRemote(message Message, outcomes []Delivery) ([]uint64, error) {
+	sender, content := message.Sender, message.Content
+	to := []string{}
+	for _, outcome := range outcomes {
+		if outcome.Status == DELIVERY_QUEUED {
+			to = append(to, outcome.Receiver)
+		}
+	}
+	if len(to) == 0 {
+		return []uint64{}, nil
+	}
+
+	source, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	// The id is reserved as for the activities in the outbox
+	noteId, err := inbox.storage.nextActivityId()
+	if err != nil {
+		return nil, err
+	}
+	baseUrl := fmt.Sprintf("%s/person/%s", os.Getenv("BASE_URL"), sender)
+	now := time.Now()
+	note := map[string]interface{}{
+		"id":           fmt.Sprintf("%s/note/%d", baseUrl, noteId),
+		"type":         "Note",
+		"attributedTo": baseUrl,
+		"to":           to,
+		"published":    now.UTC().Format(time.RFC3339),
+		"content":      string(source),
+		"source": map[string]interface{}{
+			"content":   string(source),
+			"mediaType": MESSAGE_MEDIA_TYPE,
+		},
+	}
+	// The servers that do not know the source show the text of the message
+	if text, ok := content["message"].(string); ok {
+		note["content"] = text
+	}
+	if subject, ok := content["subject"].(string); ok {
+		note["summary"] = subject
+	}
+	if message.ThreadId != nil {
+		note["context"] = fmt.Sprintf("%s/thread/%d", os.Getenv("BASE_URL"), *message.ThreadId)
+	}
+	if message.InReplyTo != nil {
+		note["inReplyTo"] = fmt.Sprintf("%s/message/%d", os.Getenv("BASE_URL"), *message.InReplyTo)
+	}
+	if message.ExpiresAt != nil {
+		note["endTime"] = message.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	create, _ := json.Marshal(map[string]interface{}{
+		"@context": "https://www.w3.org/ns/activitystreams",
+		"id":       fmt.Sprintf("%s/outbox/%d", baseUrl, noteId),
+		"type":     "Create",
+		"actor":    baseUrl,
+		"to":       to,
+		"object":   note,
+	})
+	err = inbox.storage.storeDirect(StoredActivity{
+		Id:       noteId,
+		Actor:    baseUrl,
+		Type:     "Create",
+		Activity: string(create),
+		Created:  now,
+		Audience: to,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[APUB] Send message of %s to %d actors\n", sender, len(to))
+	return inbox.deliveries.hold(baseUrl, to, create)
+}
+
+// Returns the content of the message an activity received by a person is
+// turned into, with its expiry: the content of the message, if it is a
+// direct note sent by another inbox, otherwise the activity itself, which
+// does not expire
+func messageContent(body []byte) (map[string]interface{}, *time.Time) {
+	var activity map[string]interface{}
+	json.Unmarshal(body, &activity)
+	if activity["type"] != "Create" {
+		return activity, nil
+	}
+	note, _ := activity["object"].(map[string]interface{})
+	source, _ := note["source"].(map[string]interface{})
+	if sourceContent, ok := source["content"].(string); ok && source["mediaType"] == MESSAGE_MEDIA_TYPE {
+		var content map[string]interface{}
+		if err := json.Unmarshal([]byte(sourceContent), &content); err == nil && len(content) > 0 {
+			endTime, _ := note["endTime"].(string)
+			if expiresAt, err := time.Parse(time.RFC3339, endTime); err == nil {
+				return content, &expiresAt
+			}
+			return content, nil
+		}
+	}
+	return activity, nil
+}
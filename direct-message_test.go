@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dyne/zenflows-inbox/client"
+)
+
+// Actor of another server with its own key, it accepts everything posted to
+// its inbox
+func newTestSigningActor(t *testing.T) (string, *KeyRing) {
+	var keys *KeyRing
+	remote, keys := newTestRemote(t, func(url string, path string) map[string]interface{} {
+		publicKey, err := keys.publicKeyDocument(url + "/actor")
+		if err != nil {
+			return nil
+		}
+		return map[string]interface{}{
+			"id":        url + "/actor",
+			"type":      "Person",
+			"inbox":     url + "/actor/inbox",
+			"publicKey": publicKey,
+		}
+	})
+	return remote.URL + "/actor", keys
+}
+
+// Gets the document, signed by actor if keys is not nil, and returns the
+// status and the document
+func signedGet(t *testing.T, keys *KeyRing, actor string, url string) (int, map[string]interface{}) {
+	t.Helper()
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "application/activity+json")
+	if keys != nil {
+		if err := keys.sign(actor, r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var doc map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&doc)
+	return resp.StatusCode, doc
+}
+
+func TestDirectNote(t *testing.T) {
+	ti := newTestInbox(t)
+	receiver, receiverKeys := newTestSigningActor(t)
+	other, otherKeys := newTestSigningActor(t)
+
+	content := map[string]interface{}{"message": "hi", "subject": "S"}
+	if _, err := ti.client("alice").Send([]string{receiver}, content, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := ti.deliveries(t, "")
+	if len(deliveries) != 1 {
+		t.Fatalf("Unexpected deliveries %+v", deliveries)
+	}
+	var create map[string]interface{}
+	if err := json.Unmarshal([]byte(deliveries[0].Activity), &create); err != nil {
+		t.Fatal(err)
+	}
+	createId := create["id"].(string)
+	noteId := create["object"].(map[string]interface{})["id"].(string)
+
+	// Only the receiver can fetch the note and its activity
+	for _, id := range []string{createId, noteId} {
+		if status, _ := signedGet(t, nil, "", id); status != http.StatusNotFound {
+			t.Fatalf("%s: unsigned %d", id, status)
+		}
+		if status, _ := signedGet(t, otherKeys, other, id); status != http.StatusNotFound {
+			t.Fatalf("%s: not addressed %d", id, status)
+		}
+		status, doc := signedGet(t, receiverKeys, receiver, id)
+		if status != http.StatusOK || doc["id"] != id {
+			t.Fatalf("%s: %d %v", id, status, doc)
+		}
+	}
+	if status, doc := signedGet(t, receiverKeys, receiver, noteId); doc["content"] != "hi" || doc["summary"] != "S" {
+		t.Fatal(status, doc)
+	}
+
+	// It is not in the outbox
+	status, result := ti.do(t, "GET", "/person/alice/outbox?page=true", nil, map[string]string{"Accept": "application/activity+json"})
+	if items, _ := result["orderedItems"].([]interface{}); status != http.StatusOK || len(items) != 0 {
+		t.Fatal(status, result)
+	}
+}
+
+func TestDirectNoteThread(t *testing.T) {
+	ti := newTestInbox(t)
+	receiver, _ := newTestSigningActor(t)
+	alice := ti.client("alice")
+
+	// The sender keeps the messages sent only to other servers in its
+	// threads
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if _, err := alice.SendExpiring([]string{receiver}, map[string]interface{}{"message": "hi"}, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	threads, err := alice.Threads(10, nil)
+	if err != nil || len(threads.Threads) != 1 {
+		t.Fatal(threads, err)
+	}
+	first := threads.Threads[0].Latest
+	if first.Content["message"] != "hi" || first.ExpiresAt == nil || !first.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Unexpected message %+v", first)
+	}
+	if _, err := alice.Reply(first.Id, []string{receiver}, map[string]interface{}{"message": "again"}); err != nil {
+		t.Fatal(err)
+	}
+	page, err := alice.Thread(first.ThreadId, 10, nil)
+	if err != nil || len(page.Messages) != 2 {
+		t.Fatal(page, err)
+	}
+
+	notes := map[string]map[string]interface{}{}
+	var create string
+	for _, delivery := range ti.deliveries(t, "") {
+		var activity map[string]interface{}
+		if err := json.Unmarshal([]byte(delivery.Activity), &activity); err != nil {
+			t.Fatal(err)
+		}
+		note := activity["object"].(map[string]interface{})
+		notes[note["content"].(string)] = note
+		if note["content"] == "hi" {
+			create = delivery.Activity
+		}
+	}
+	if note := notes["hi"]; note["endTime"] != expiresAt.UTC().Format(time.RFC3339) || note["inReplyTo"] != nil || note["context"] != nil {
+		t.Fatalf("Unexpected note %v", note)
+	}
+	reply := notes["again"]
+	if reply["context"] != fmt.Sprintf("%s/thread/%d", ti.server.URL, first.ThreadId) ||
+		reply["inReplyTo"] != fmt.Sprintf("%s/message/%d", ti.server.URL, first.Id) || reply["endTime"] != nil {
+		t.Fatalf("Unexpected reply %v", reply)
+	}
+
+	// A person that receives the note gets a message with its expiry
+	aliceUrl := ti.server.URL + "/person/alice"
+	if status := deliver(t, ti.keys, aliceUrl, ti.server.URL+"/person/bob/inbox", create); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	read, err := ti.client("bob").Read(client.ReadQuery{})
+	if err != nil || len(read.Messages) != 1 {
+		t.Fatal(read, err)
+	}
+	if message := read.Messages[0]; message.Sender != aliceUrl || message.ExpiresAt == nil || !message.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("Unexpected message %+v", message)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tarantool/go-tarantool"
+)
+
+// Every failed response has the envelope
+//
+//	{"success": false, "error": "<message>", "code": "<code>"}
+//
+// where code is one of the following and decides the HTTP status
+const (
+	CODE_BAD_REQUEST          = "bad_request"
+	CODE_BAD_SIGNATURE        = "bad_signature"
+	CODE_UNKNOWN_AGENT        = "unknown_agent"
+	CODE_STALE_REQUEST        = "stale_request"
+	CODE_REPLAYED_REQUEST     = "replayed_request"
+	CODE_UNAUTHORIZED         = "unauthorized"
+	CODE_FORBIDDEN            = "forbidden"
+	CODE_NOT_FOUND            = "not_found"
+	CODE_SEND_ABORTED         = "send_aborted"
+	CODE_ZENFLOWS_UNAVAILABLE = "zenflows_unavailable"
+	CODE_REMOTE_UNAVAILABLE   = "remote_unavailable"
+	CODE_STORAGE_UNAVAILABLE  = "storage_unavailable"
+	CODE_STORAGE_ERROR        = "storage_error"
+	CODE_INTERNAL_ERROR       = "internal_error"
+)
+
+var codeStatus = map[string]int{
+	CODE_BAD_REQUEST:          http.StatusBadRequest,
+	CODE_BAD_SIGNATURE:        http.StatusUnauthorized,
+	CODE_UNKNOWN_AGENT:        http.StatusUnauthorized,
+	CODE_STALE_REQUEST:        http.StatusUnauthorized,
+	CODE_REPLAYED_REQUEST:     http.StatusUnauthorized,
+	CODE_UNAUTHORIZED:         http.StatusUnauthorized,
+	CODE_FORBIDDEN:            http.StatusForbidden,
+	CODE_NOT_FOUND:            http.StatusNotFound,
+	CODE_SEND_ABORTED:         http.StatusUnprocessableEntity,
+	CODE_ZENFLOWS_UNAVAILABLE: http.StatusBadGateway,
+	CODE_REMOTE_UNAVAILABLE:   http.StatusBadGateway,
+	CODE_STORAGE_UNAVAILABLE:  http.StatusServiceUnavailable,
+	CODE_STORAGE_ERROR:        http.StatusInternalServerError,
+	CODE_INTERNAL_ERROR:       http.StatusInternalServerError,
+}
+
+var (
+	ErrNotFound            = errors.New("Not found")
+	ErrBadSignature        = errors.New("Signature is not authentic")
+	ErrZenflowsUnavailable = errors.New("Zenflows is not available")
+	ErrRemoteUnavailable   = errors.New("Remote server is not available")
+)
+
+// An error with its code, for the failures that are not recognized by
+// classify from the error itself
+type ApiError struct {
+	Code string
+	Err  error
+}
+
+func (e *ApiError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ApiError) Status() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func apiErrorf(code string, format string, a ...interface{}) *ApiError {
+	return &ApiError{code, fmt.Errorf(format, a...)}
+}
+
+// Returns the code of an error
+func classify(err error) *ApiError {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	code := CODE_INTERNAL_ERROR
+	var (
+		syntaxErr  *json.SyntaxError
+		typeErr    *json.UnmarshalTypeError
+		numErr     *strconv.NumError
+		timeErr    *time.ParseError
+		clientErr  tarantool.ClientError
+		storageErr tarantool.Error
+	)
+	switch {
+	case errors.Is(err, ErrStaleRequest):
+		code = CODE_STALE_REQUEST
+	case errors.Is(err, ErrReplayedRequest):
+		code = CODE_REPLAYED_REQUEST
+	case errors.Is(err, ErrUnknownAgent):
+		code = CODE_UNKNOWN_AGENT
+	case errors.Is(err, ErrBadSignature), errors.Is(err, ErrBadHttpSignature):
+		code = CODE_BAD_SIGNATURE
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrActivityNotFound), errors.Is(err, ErrDeliveryNotFound):
+		code = CODE_NOT_FOUND
+	case errors.Is(err, ErrSendAborted):
+		code = CODE_SEND_ABORTED
+	case errors.Is(err, ErrZenflowsUnavailable):
+		code = CODE_ZENFLOWS_UNAVAILABLE
+	case errors.Is(err, ErrRemoteUnavailable):
+		code = CODE_REMOTE_UNAVAILABLE
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.As(err, &numErr), errors.As(err, &timeErr):
+		code = CODE_BAD_REQUEST
+	case errors.As(err, &clientErr):
+		code = CODE_STORAGE_UNAVAILABLE
+	case errors.As(err, &storageErr):
+		code = CODE_STORAGE_ERROR
+	}
+	return &ApiError{code, err}
+}
+
+// Sets the error and its code in the json response
+func setError(result map[string]interface{}, err error) {
+	apiErr := classify(err)
+	result["success"] = false
+	result["error"] = apiErr.Error()
+	result["code"] = apiErr.Code
+}
+
+// Returns the status of the response, given by the code of the error
+func resultStatus(result map[string]interface{}) int {
+	if result["success"] == true {
+		return http.StatusOK
+	}
+	code, _ := result["code"].(string)
+	return (&ApiError{Code: code}).Status()
+}
+
+func respondJSON(c *gin.Context, result map[string]interface{}) {
+	c.JSON(resultStatus(result), result)
+}
+
+// Stops the chain of handlers with the error, used by the middlewares
+func abortWithError(c *gin.Context, err error) {
+	result := map[string]interface{}{}
+	setError(result, err)
+	c.AbortWithStatusJSON(resultStatus(result), result)
+}
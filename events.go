@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Something that happened in the inbox of Receiver, it is pushed to the
+// subscribers of the receiver
+type Event struct {
+	Id       uint64                 `json:"id"`
+	Receiver string                 `json:"receiver"`
+	Type     string                 `json:"type"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+const (
+	EVENT_MESSAGE = "message"
+	EVENT_READ    = "read"
+)
+
+// Buffered events per subscriber, slower subscribers are disconnected
+const SUBSCRIBER_BUFFER = 64
+
+// The ids of the events are taken when they are stored, but the transactions
+// can commit in another order: each poll reads again this many ids before
+// the last one seen, so that an event committed late is not skipped
+const EVENTS_OVERLAP = 100
+
+// The hub polls the events stored by any instance of the service (they share
+// the same storage) and dispatches them to the local subscribers
+type Hub struct {
+	storage Storage
+	last    uint64
+	// Ids of the events dispatched (or stored before the hub started) within
+	// the overlap, each event is dispatched once
+	seen map[uint64]struct{}
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func NewHub(storage Storage) (*Hub, error) {
+	last, err := storage.lastEventId()
+	if err != nil {
+		return nil, err
+	}
+	hub := &Hub{
+		storage:     storage,
+		last:        last,
+		seen:        make(map[uint64]struct{}),
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+	// The events already stored are not dispatched
+	events, err := storage.events(hub.floor(), EVENTS_OVERLAP)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		hub.seen[event.Id] = struct{}{}
+	}
+	return hub, nil
+}
+
+// Returns the id after which the events are read again
+func (hub *Hub) floor() uint64 {
+	if hub.last < EVENTS_OVERLAP {
+		return 0
+	}
+	return hub.last - EVENTS_OVERLAP
+}
+
+// Returns a channel that receives the events of receiver, the channel is
+// closed by unsubscribe or if the subscriber is too slow
+func (hub *Hub) subscribe(receiver string) chan Event {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+	if hub.subscribers[receiver] == nil {
+		hub.subscribers[receiver] = make(map[chan Event]struct{})
+	}
+	hub.subscribers[receiver][ch] = struct{}{}
+	return ch
+}
+
+func (hub *Hub) unsubscribe(receiver string, ch chan Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if _, ok := hub.subscribers[receiver][ch]; ok {
+		delete(hub.subscribers[receiver], ch)
+		close(ch)
+	}
+	if len(hub.subscribers[receiver]) == 0 {
+		delete(hub.subscribers, receiver)
+	}
+}
+
+func (hub *Hub) dispatch(event Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch := range hub.subscribers[event.Receiver] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Subscriber of %s is too slow, closing\n", event.Receiver)
+			delete(hub.subscribers[event.Receiver], ch)
+			close(ch)
+		}
+	}
+}
+
+func (hub *Hub) poll() error {
+	after := hub.floor()
+	for {
+		events, err := hub.storage.events(after, LIMIT_MSG)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if _, ok := hub.seen[event.Id]; !ok {
+				hub.dispatch(event)
+				hub.seen[event.Id] = struct{}{}
+			}
+			if event.Id > hub.last {
+				hub.last = event.Id
+			}
+			after = event.Id
+		}
+		if len(events) < LIMIT_MSG {
+			break
+		}
+	}
+	floor := hub.floor()
+	for id := range hub.seen {
+		if id <= floor {
+			delete(hub.seen, id)
+		}
+	}
+	return nil
+}
+
+// Polls the storage forever, it has to be run in its own goroutine
+func (hub *Hub) run(interval time.Duration) {
+	for {
+		if err := hub.poll(); err != nil {
+			log.Println("Could not read the events:", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Subscribes to the events of receiver and returns the response and its lines
+func subscribe(t *testing.T, ti *testInbox, receiver string) (*http.Response, chan string) {
+	t.Helper()
+	body, err := json.Marshal(signed(map[string]interface{}{"receiver": receiver}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ti.client(receiver).Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", ti.server.URL+"/subscribe", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("zenflows-sign", signature)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return resp, lines
+}
+
+// Waits for a line starting with prefix
+func expectLine(t *testing.T, lines chan string, prefix string) string {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("Stream closed before %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("No line %q in time", prefix)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ti := newTestInbox(t)
+	resp, lines := subscribe(t, ti, "bob")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal(resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	expectLine(t, lines, ": subscribed")
+
+	if _, err := ti.client("alice").Send([]string{"bob"}, map[string]interface{}{"message": "hi"}, false); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, lines, "event:"+EVENT_MESSAGE)
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(expectLine(t, lines, "data:"), "data:")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Receiver != "bob" || event.Type != EVENT_MESSAGE {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if err := ti.client("bob").SetRead(0, true); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, lines, "event:"+EVENT_READ)
+}
+
+func TestSubscribeUnsigned(t *testing.T) {
+	ti := newTestInbox(t)
+	status, result := ti.do(t, "POST", "/subscribe", []byte(`{"receiver": "bob"}`), nil)
+	if status != http.StatusUnauthorized || result["code"] != CODE_BAD_SIGNATURE {
+		t.Fatal(status, result)
+	}
+}
+
+// Events committed in any order, as the transactions of the storage can do
+type lateEventsStorage struct {
+	*MemStorage
+	mu        sync.Mutex
+	committed []Event
+}
+
+func (storage *lateEventsStorage) commit(id uint64) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.committed = append(storage.committed, Event{Id: id, Receiver: "bob", Type: EVENT_MESSAGE})
+	sort.Slice(storage.committed, func(i, j int) bool {
+		return storage.committed[i].Id < storage.committed[j].Id
+	})
+}
+
+func (storage *lateEventsStorage) events(after uint64, limit int) ([]Event, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	var events []Event
+	for _, event := range storage.committed {
+		if event.Id > after && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func TestHubLateEvents(t *testing.T) {
+	storage := &lateEventsStorage{MemStorage: &MemStorage{}}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storage.commit(1)
+	hub, err := NewHub(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := hub.subscribe("bob")
+	received := func() []uint64 {
+		if err := hub.poll(); err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for len(ch) > 0 {
+			ids = append(ids, (<-ch).Id)
+		}
+		return ids
+	}
+
+	// The event stored before the hub started is not dispatched
+	storage.commit(2)
+	storage.commit(4)
+	if ids := received(); !reflect.DeepEqual(ids, []uint64{2, 4}) {
+		t.Fatal(ids)
+	}
+	storage.commit(3)
+	if ids := received(); !reflect.DeepEqual(ids, []uint64{3}) {
+		t.Fatal(ids)
+	}
+	if ids := received(); len(ids) != 0 {
+		t.Fatal(ids)
+	}
+}
@@ -2,6 +2,7 @@
 import sign from "./sign_graphql.mjs"
 import { zencode_exec } from 'zenroom';
 import axios from 'axios';
+import { randomUUID } from 'crypto';
 
 const PIPPO_EDDSA = "EtJtSqAG9mVHfKrKduS6aeyAE6okGXrfMW8fEQ6eqenh"
 const PIPPO_ID = "062TE0H7591KJCVT3DDEMDBF0R"
@@ -13,6 +14,13 @@ const PAPERINO_ID = "062TE18QJSQJ1PY6G1M7783148"
 const url="http://localhost:5000"
 //const url="https://gateway0.interfacer.dyne.org/inbox"
 
+// Every signed request carries a timestamp and a nonce, so that it cannot be
+// replayed
+const fresh = () => ({
+    timestamp: Date.now(),
+    nonce: randomUUID(),
+})
+
 const signRequest = async (json, key) => {
 	const data = `{"gql": "${Buffer.from(json, 'utf8').toString('base64')}"}`
     const keys = `{"keyring": {"eddsa": "${key}"}}`
@@ -24,6 +32,7 @@ const signRequest = async (json, key) => {
 
 const sendMessage = async (message) => {
     const request = {
+        ...fresh(),
         sender: PIPPO_ID,
         receivers: [PAPERINO_ID,PLUTO_ID],
         content: {
@@ -54,6 +63,7 @@ const assertPostMany = async() => {
 
 const readMessages = async(email, key) => {
     const request = {
+        ...fresh(),
         request_id: 42,
         receiver: email,
         //only_unread: true,
@@ -82,6 +92,7 @@ const assertReadMany = async(email, key) => {
 
 const setMessage = async(message_id, receiver, read, key) => {
     const request = {
+        ...fresh(),
         message_id,
         receiver,
         read
@@ -98,6 +109,7 @@ const setMessage = async(message_id, receiver, read, key) => {
 
 const countMessages = async(receiver, key) => {
     const request = {
+        ...fresh(),
         receiver,
     }
     const requestJSON = JSON.stringify(request)
@@ -112,6 +124,7 @@ const countMessages = async(receiver, key) => {
 
 const deleteMessage = async(receiver, messageId, key) => {
     const request = {
+        ...fresh(),
         receiver,
         message_id: messageId,
     }
@@ -2,6 +2,7 @@
 import sign from "./sign_graphql.mjs"
 import { zencode_exec } from 'zenroom';
 import axios from 'axios';
+import { randomUUID } from 'crypto';
 
 const PIPPO_EDDSA = "EtJtSqAG9mVHfKrKduS6aeyAE6okGXrfMW8fEQ6eqenh"
 const PIPPO_ID = "062TE0H7591KJCVT3DDEMDBF0R"
@@ -29,7 +30,9 @@ const useLikeObject = async () => {
     "type": "Like",
     "actor": `${url0}/person/062TE0H7591KJCVT3DDEMDBF0R`,
     "object": `${url1}/economicresource/062SE9RG34DDHTEHHRWY8VKCJW`,
-    "published": "2014-09-30T12:34:56Z"
+    "published": "2014-09-30T12:34:56Z",
+    "timestamp": Date.now(),
+    "nonce": randomUUID(),
   }
   const requestJSON = JSON.stringify(request)
   const requestHeaders = await signRequest(requestJSON, PIPPO_EDDSA);
@@ -47,7 +50,9 @@ const useFollowActivity = async () => {
     "type": "Follow",
     "actor": `${url0}/person/${PIPPO_ID}`,
     "object": `${url0}/person/${PAPERINO_ID}`,
-    "published": "2014-09-30T12:34:56Z"
+    "published": "2014-09-30T12:34:56Z",
+    "timestamp": Date.now(),
+    "nonce": randomUUID(),
   }
   const requestJSON = JSON.stringify(request)
   const requestHeaders = await signRequest(requestJSON, PIPPO_EDDSA);
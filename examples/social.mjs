@@ -2,6 +2,7 @@
 import sign from "./sign_graphql.mjs"
 import { zencode_exec } from 'zenroom';
 import axios from 'axios';
+import { randomUUID } from 'crypto';
 
 const PIPPO_EDDSA = "EtJtSqAG9mVHfKrKduS6aeyAE6okGXrfMW8fEQ6eqenh"
 const PIPPO_ID = "062TE0H7591KJCVT3DDEMDBF0R"
@@ -28,7 +29,9 @@ const useLikeObject = async () => {
     "type": "Like",
     "actor": "https://gatewat0.interfacer.dyne.org/inbox/social/062TE0H7591KJCVT3DDEMDBF0R",
     "object": "https://gateway0.interfacer.dyne.org/inbox/economicresource/062SE9RG34DDHTEHHRWY8VKCJW",
-    "published": "2014-09-30T12:34:56Z"
+    "published": "2014-09-30T12:34:56Z",
+    "timestamp": Date.now(),
+    "nonce": randomUUID(),
   }
   const requestJSON = JSON.stringify(request)
   const requestHeaders = await signRequest(requestJSON, PIPPO_EDDSA);
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Messages removed by each call to the storage
+const EXPIRY_BATCH = 100
+
+// Sets ExpiresAt from Ttl, the earliest of the two is kept
+func (message *Message) setExpiry(now time.Time) error {
+	if message.Ttl < 0 {
+		return apiErrorf(CODE_BAD_REQUEST, "Negative ttl")
+	}
+	if message.Ttl > 0 {
+		expiresAt := now.Add(time.Duration(message.Ttl) * time.Second)
+		if message.ExpiresAt == nil || expiresAt.Before(*message.ExpiresAt) {
+			message.ExpiresAt = &expiresAt
+		}
+	}
+	if message.ExpiresAt != nil && !message.ExpiresAt.After(now) {
+		return apiErrorf(CODE_BAD_REQUEST, "The message has already expired")
+	}
+	return nil
+}
+
+// Deletes the expired messages and, if retention is not zero, the ones
+// older than retention
+type Expiry struct {
+	storage   Storage
+	retention time.Duration
+}
+
+// Deletes the messages that have expired at now, returns how many
+func (expiry *Expiry) expire(now time.Time) (int, error) {
+	var createdBefore *time.Time
+	if expiry.retention > 0 {
+		deadline := now.Add(-expiry.retention)
+		createdBefore = &deadline
+	}
+	total := 0
+	for {
+		count, err := expiry.storage.expireMessages(now, createdBefore, EXPIRY_BATCH)
+		total += count
+		if err != nil || count < EXPIRY_BATCH {
+			return total, err
+		}
+	}
+}
+
+// Removes the expired messages forever, it has to be run in its own
+// goroutine
+func (expiry *Expiry) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		count, err := expiry.expire(time.Now())
+		if err != nil {
+			log.Println("Could not delete the expired messages:", err.Error())
+		} else if count > 0 {
+			log.Printf("Deleted %d expired messages\n", count)
+		}
+	}
+}
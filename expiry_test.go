@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dyne/zenflows-inbox/client"
+)
+
+func TestExpiringMessages(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob := ti.client("alice"), ti.client("bob")
+
+	_, err := alice.SendExpiring([]string{"bob"}, map[string]interface{}{"message": "late"}, time.Now().Add(-time.Second))
+	expectCode(t, err, http.StatusBadRequest, CODE_BAD_REQUEST)
+	if _, err := alice.SendExpiring([]string{"bob"}, map[string]interface{}{"message": "tmp"}, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Send([]string{"bob", "carol"}, map[string]interface{}{"message": "keep"}, false); err != nil {
+		t.Fatal(err)
+	}
+	status, result := ti.post(t, "/send", signed(map[string]interface{}{
+		"sender": "alice", "receivers": []string{"bob"}, "content": map[string]interface{}{"message": "ttl"}, "ttl": 60,
+	}))
+	if status != http.StatusOK || result["success"] != true {
+		t.Fatal(status, result)
+	}
+
+	page, err := bob.Read(client.ReadQuery{})
+	if err != nil || len(page.Messages) != 3 || page.Messages[0].ExpiresAt == nil ||
+		page.Messages[1].ExpiresAt != nil || page.Messages[2].ExpiresAt == nil {
+		t.Fatal(page, err)
+	}
+	if count, err := bob.CountUnread(); err != nil || count != 3 {
+		t.Fatal(count, err)
+	}
+
+	// Expired messages are hidden before they are removed
+	time.Sleep(1100 * time.Millisecond)
+	page, err = bob.Read(client.ReadQuery{})
+	if err != nil || len(page.Messages) != 2 || page.Messages[0].Content["message"] != "keep" {
+		t.Fatal(page, err)
+	}
+	if count, err := bob.CountUnread(); err != nil || count != 2 {
+		t.Fatal(count, err)
+	}
+	if threads, err := bob.Threads(0, nil); err != nil || len(threads.Threads) != 2 {
+		t.Fatal(threads, err)
+	}
+
+	removed, err := (&Expiry{storage: ti.storage}).expire(time.Now())
+	if err != nil || removed != 1 || len(ti.storage.messages) != 2 || len(ti.storage.receivers) != 3 {
+		t.Fatal(removed, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob, carol := ti.client("alice"), ti.client("bob"), ti.client("carol")
+
+	if _, err := alice.Send([]string{"bob", "carol"}, map[string]interface{}{"message": "hi"}, false); err != nil {
+		t.Fatal(err)
+	}
+	page, err := bob.Read(client.ReadQuery{})
+	if err != nil || len(page.Messages) != 1 {
+		t.Fatal(page, err)
+	}
+	id := page.Messages[0].Id
+	// The message is removed with its last receiver
+	if err := bob.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ti.storage.messages[uint64(id)]; !ok {
+		t.Fatal("Message removed while carol has it")
+	}
+	if err := carol.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ti.storage.messages[uint64(id)]; ok {
+		t.Fatal("Message kept without receivers")
+	}
+
+	// Older than the retention, in more than one batch
+	for i := 0; i < EXPIRY_BATCH+5; i++ {
+		if _, err := ti.storage.send(Message{Sender: "alice", Receivers: []string{"bob"}, Content: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiry := &Expiry{storage: ti.storage, retention: time.Nanosecond}
+	removed, err := expiry.expire(time.Now().Add(time.Millisecond))
+	if err != nil || removed != EXPIRY_BATCH+5 || len(ti.storage.messages) != 0 || len(ti.storage.receivers) != 0 {
+		t.Fatal(removed, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What an actor does with the follow requests it receives
+const (
+	FOLLOW_POLICY_AUTO   = "auto"
+	FOLLOW_POLICY_MANUAL = "manual"
+	FOLLOW_POLICY_DENY   = "deny"
+)
+
+func validFollowPolicy(policy string) bool {
+	return policy == FOLLOW_POLICY_AUTO || policy == FOLLOW_POLICY_MANUAL || policy == FOLLOW_POLICY_DENY
+}
+
+// Accepts or rejects the follow request cod received by the local actor
+// baseUrl, the answer is delivered to the follower
+func (inbox *Inbox) answerFollow(baseUrl string, cod uint64, accept bool) (*Activity, uint64, error) {
+	follow, err := inbox.storage.findActorFollow(cod)
+	if err != nil {
+		return nil, 0, err
+	}
+	if follow.Object != baseUrl {
+		return nil, 0, apiErrorf(CODE_NOT_FOUND, "Unknown follow request %d", cod)
+	}
+	answer := &Activity{
+		Context:  "https://www.w3.org/ns/activitystreams",
+		Type:     "Accept",
+		Actor:    baseUrl,
+		Object:   follow.Id,
+		Embedded: follow,
+	}
+	if accept {
+		err = inbox.storage.acceptFollower(cod)
+	} else {
+		answer.Type = "Reject"
+		err = inbox.storage.rejectFollower(cod)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tmp, _ := json.Marshal(answer)
+	otherInbox := fmt.Sprintf("%s/inbox", follow.Actor)
+	log.Printf("[APUB] Send %s to %s\n", answer.Type, otherInbox)
+	deliveryId, err := inbox.deliveries.enqueue(answer.Actor, otherInbox, tmp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not deliver %s: %w", answer.Type, err)
+	}
+	return answer, deliveryId, nil
+}
+
+// Finds the follow request of the local actor baseUrl that is answered (by
+// Accept or Reject) by the followed actor
+func (inbox *Inbox) answeredFollow(baseUrl string, answer Activity) (uint64, error) {
+	follow, cod, err := inbox.findOwnActivity(baseUrl, answer.Object)
+	if err != nil {
+		return 0, err
+	}
+	if follow.Type != "Follow" || follow.Object != answer.Actor {
+		return 0, apiErrorf(CODE_BAD_REQUEST, "%s is not a follow of %s", answer.Object, answer.Actor)
+	}
+	return cod, nil
+}
+
+// Returns the url of the local actor of a request about its follows, after
+// checking the signature of body: actorType is "person" (the default) or
+// "economicresource", whose requests are signed by its primary accountable
+func (inbox *Inbox) followsActor(body []byte, signature string, actorType string, id string) (string, error) {
+	switch actorType {
+	case "":
+		actorType = "person"
+	case "person", "economicresource":
+	default:
+		return "", apiErrorf(CODE_BAD_REQUEST, "Unknown actor type: %s", actorType)
+	}
+	signer, err := inbox.actorOwner(actorType, id)
+	if err != nil {
+		return "", err
+	}
+	if err := inbox.authenticate(body, signature, signer); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id), nil
+}
+
+type FollowPolicy struct {
+	Id     string `json:"id"`
+	Type   string `json:"type"`
+	Policy string `json:"policy"`
+}
+
+// Sets the follow policy of an actor, see followsActor
+func (inbox *Inbox) followPolicyHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	var followPolicy FollowPolicy
+	err = json.Unmarshal(body, &followPolicy)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	if !validFollowPolicy(followPolicy.Policy) {
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "Unknown follow policy: %s", followPolicy.Policy))
+		return
+	}
+	baseUrl, err := inbox.followsActor(body, c.Request.Header.Get("zenflows-sign"), followPolicy.Type, followPolicy.Id)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	if err := inbox.storage.setFollowPolicy(baseUrl, followPolicy.Policy); err != nil {
+		setError(result, err)
+		return
+	}
+
+	result["success"] = true
+	result["data"] = followPolicy.Policy
+}
+
+type FollowRequests struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// Lists the pending follow requests received by an actor
+func (inbox *Inbox) followRequestsHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	var followRequests FollowRequests
+	err = json.Unmarshal(body, &followRequests)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	baseUrl, err := inbox.followsActor(body, c.Request.Header.Get("zenflows-sign"), followRequests.Type, followRequests.Id)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	requests, err := inbox.storage.pendingFollowers(baseUrl)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	if requests == nil {
+		requests = []FollowRequest{}
+	}
+
+	result["success"] = true
+	result["data"] = requests
+}
+
+type AnswerFollow struct {
+	Id     string `json:"id"`
+	Type   string `json:"type"`
+	Follow uint64 `json:"follow"`
+}
+
+// Approves (accept is true) or rejects a follow request received by an
+// actor, it can also reject a follower that was already accepted
+func (inbox *Inbox) answerFollowHandler(accept bool) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondJSON(c, result)
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+
+		var answerFollow AnswerFollow
+		err = json.Unmarshal(body, &answerFollow)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		baseUrl, err := inbox.followsActor(body, c.Request.Header.Get("zenflows-sign"), answerFollow.Type, answerFollow.Id)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+
+		answer, deliveryId, err := inbox.answerFollow(baseUrl, answerFollow.Follow, accept)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+
+		result["success"] = true
+		result["data"] = answer
+		result["delivery"] = deliveryId
+	}
+}
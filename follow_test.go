@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/dyne/zenflows-inbox/client"
+)
+
+// Follows object as actor (local persons) and waits for the Accept
+func (ti *testInbox) follow(t *testing.T, actor string, object string) {
+	t.Helper()
+	actorUrl, objectUrl := ti.server.URL+"/person/"+actor, ti.server.URL+"/person/"+object
+	_, err := ti.client(actor).PostActivity("person", actor, map[string]interface{}{
+		"type": "Follow", "actor": actorUrl, "object": objectUrl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		following, _ := ti.storage.findActorFollows(actorUrl, true)
+		for _, id := range following {
+			if id == objectUrl {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestFollowCollections(t *testing.T) {
+	ti := newTestInbox(t)
+	ti.follow(t, "P1", "P2")
+	ti.follow(t, "P3", "P2")
+
+	followers := ti.getActivity(t, "/person/P2/follower")
+	if items, _ := followers["orderedItems"].([]interface{}); followers["totalItems"] != 2.0 || len(items) != 2 {
+		t.Fatal(followers)
+	}
+	following := ti.getActivity(t, "/person/P1/following")
+	if following["totalItems"] != 1.0 || following["id"] != ti.server.URL+"/person/P1/following" {
+		t.Fatal(following)
+	}
+	// The plain JSON has the total too
+	if status, result := ti.do(t, "GET", "/person/P2/follower", nil, nil); status != http.StatusOK || result["totalItems"] != 2.0 {
+		t.Fatal(status, result)
+	}
+}
+
+// Returns whether the follow of following by follower is accepted and
+// whether it is rejected, ok is false if there is no follow
+func (ti *testInbox) followState(follower string, following string) (accepted bool, rejected bool, ok bool) {
+	ti.storage.mu.Lock()
+	defer ti.storage.mu.Unlock()
+	cod, ok := ti.storage.findFollow(following, follower)
+	if !ok {
+		return false, false, false
+	}
+	follow := ti.storage.follow[cod]
+	return follow.accepted, follow.rejected, true
+}
+
+// Posts the follow request of actor, without waiting for the answer
+func (ti *testInbox) requestFollow(t *testing.T, actor string, object string) {
+	t.Helper()
+	_, err := ti.client(actor).PostActivity("person", actor, map[string]interface{}{
+		"type": "Follow", "actor": ti.server.URL + "/person/" + actor, "object": object,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowPolicies(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2, p3 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2", ti.server.URL+"/person/P3"
+	if err := ti.client("P2").SetFollowPolicy(FOLLOW_POLICY_MANUAL); err != nil {
+		t.Fatal(err)
+	}
+	if err := ti.client("P3").SetFollowPolicy(FOLLOW_POLICY_DENY); err != nil {
+		t.Fatal(err)
+	}
+	err := ti.client("P2").SetFollowPolicy("maybe")
+	expectCode(t, err, http.StatusBadRequest, CODE_BAD_REQUEST)
+	if actor := ti.getActivity(t, "/person/P2"); actor["manuallyApprovesFollowers"] != true {
+		t.Fatal(actor)
+	}
+
+	// The request to P2 waits for its approval
+	ti.requestFollow(t, "P1", p2)
+	var requests []client.FollowRequest
+	eventually(t, func() bool {
+		requests, err = ti.client("P2").FollowRequests()
+		return err == nil && len(requests) == 1
+	})
+	if requests[0].Actor != p1 {
+		t.Fatal(requests)
+	}
+	if accepted, _, _ := ti.followState(p1, p2); accepted {
+		t.Fatal("Accepted before the approval")
+	}
+	if _, err := ti.client("P2").AnswerFollow(requests[0].Id, true); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		accepted, _, _ := ti.followState(p1, p2)
+		return accepted
+	})
+	if requests, err := ti.client("P2").FollowRequests(); err != nil || len(requests) != 0 {
+		t.Fatal(requests, err)
+	}
+
+	// An approved follower can be rejected later
+	if _, err := ti.client("P2").AnswerFollow(requests[0].Id, false); err != nil {
+		t.Fatal(err)
+	}
+	if accepted, rejected, _ := ti.followState(p1, p2); accepted || !rejected {
+		t.Fatal(accepted, rejected)
+	}
+	// Only the followed actor can answer
+	_, err = ti.client("P1").AnswerFollow(requests[0].Id, true)
+	expectCode(t, err, http.StatusNotFound, CODE_NOT_FOUND)
+
+	// P3 rejects every request
+	ti.requestFollow(t, "P1", p3)
+	eventually(t, func() bool {
+		_, rejected, _ := ti.followState(p1, p3)
+		return rejected
+	})
+	if requests, err := ti.client("P3").FollowRequests(); err != nil || len(requests) != 0 {
+		t.Fatal(requests, err)
+	}
+}
+
+func TestFollowRejected(t *testing.T) {
+	ti := newTestInbox(t)
+	p1 := ti.server.URL + "/person/P1"
+	remote, keys := newTestSigningActor(t)
+
+	result, err := ti.client("P1").PostActivity("person", "P1", map[string]interface{}{
+		"type": "Follow", "actor": p1, "object": remote,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	followId := result["data"].(map[string]interface{})["id"].(string)
+
+	answer := func(answerType string) {
+		t.Helper()
+		activity := `{"type": "` + answerType + `", "actor": "` + remote + `", "object": "` + followId + `"}`
+		if status := deliver(t, keys, remote, p1+"/inbox", activity); status != http.StatusOK {
+			t.Fatal(answerType, status)
+		}
+	}
+	answer("Accept")
+	if accepted, _, _ := ti.followState(p1, remote); !accepted {
+		t.Fatal("Not accepted")
+	}
+	answer("Reject")
+	if accepted, rejected, _ := ti.followState(p1, remote); accepted || !rejected {
+		t.Fatal(accepted, rejected)
+	}
+	if following := ti.getActivity(t, "/person/P1/following"); following["totalItems"] != 0.0 {
+		t.Fatal(following)
+	}
+}
+
+func TestResourceFollowPolicy(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, r1 := ti.server.URL+"/person/P1", ti.server.URL+"/economicresource/R1"
+	// The resource is managed by alice, who has her own key
+	ti.zenflows.setResource("R1", "alice")
+	ti.zenflows.setPubkey("alice", TEST_OTHER_PK)
+	alice := client.New(ti.server.URL, "alice", TEST_OTHER_SK)
+	post := func(signer *client.Client, path string, request map[string]interface{}) (int, map[string]interface{}) {
+		t.Helper()
+		request["type"] = "economicresource"
+		body, err := json.Marshal(signed(request))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := signer.Sign(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ti.do(t, "POST", path, body, map[string]string{"zenflows-sign": signature})
+	}
+
+	if status, result := post(ti.client("R1"), "/follow-policy", map[string]interface{}{"id": "R1", "policy": FOLLOW_POLICY_MANUAL}); status != http.StatusUnauthorized {
+		t.Fatal(status, result)
+	}
+	if status, result := post(alice, "/follow-policy", map[string]interface{}{"id": "R1", "policy": FOLLOW_POLICY_MANUAL}); status != http.StatusOK {
+		t.Fatal(status, result)
+	}
+
+	ti.requestFollow(t, "P1", r1)
+	var requests []interface{}
+	eventually(t, func() bool {
+		_, result := post(alice, "/follow-requests", map[string]interface{}{"id": "R1"})
+		requests, _ = result["data"].([]interface{})
+		return len(requests) == 1
+	})
+	follow := requests[0].(map[string]interface{})["id"]
+	if status, result := post(alice, "/follow-requests/approve", map[string]interface{}{"id": "R1", "follow": follow}); status != http.StatusOK {
+		t.Fatal(status, result)
+	}
+	eventually(t, func() bool {
+		accepted, _, _ := ti.followState(p1, r1)
+		return accepted
+	})
+}
+
+// Returns the deliveries of activities of type activityType to target
+func (ti *testInbox) deliveriesOf(t *testing.T, activityType string, target string) []QueuedDelivery {
+	t.Helper()
+	var found []QueuedDelivery
+	for _, delivery := range ti.deliveries(t, "") {
+		var activity Activity
+		if err := json.Unmarshal([]byte(delivery.Activity), &activity); err != nil {
+			t.Fatal(err)
+		}
+		if activity.Type == activityType && delivery.Target == target {
+			found = append(found, delivery)
+		}
+	}
+	return found
+}
+
+func TestUndoFollow(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2"
+	ti.follow(t, "P1", "P2")
+	following, err := ti.storage.findActorFollows(p1, true)
+	if err != nil || len(following) != 1 {
+		t.Fatal(following, err)
+	}
+
+	// The follow is undone by its id, the Undo goes to P2
+	cod, _ := ti.storage.findFollow(p2, p1)
+	followId := fmt.Sprintf("%s/follower/%d", p1, cod)
+	result, err := ti.client("P1").PostActivity("person", "P1", map[string]interface{}{
+		"type": "Undo", "actor": p1, "object": followId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undone := result["data"].(map[string]interface{})["object"].(map[string]interface{}); undone["id"] != followId {
+		t.Fatal(result)
+	}
+	if len(ti.deliveriesOf(t, "Undo", p2+"/inbox")) != 1 {
+		t.Fatal(ti.deliveries(t, ""))
+	}
+	for _, path := range []string{"/person/P1/following", "/person/P2/follower"} {
+		if collection := ti.getActivity(t, path); collection["totalItems"] != 0.0 {
+			t.Fatal(path, collection)
+		}
+	}
+	// It cannot be undone twice
+	_, err = ti.client("P1").PostActivity("person", "P1", map[string]interface{}{
+		"type": "Undo", "actor": p1, "object": followId,
+	})
+	if err == nil {
+		t.Fatal("Undone twice")
+	}
+
+	// A remote actor follows P1 and then takes it back
+	remote, keys := newTestSigningActor(t)
+	follow := `{"type": "Follow", "actor": "` + remote + `", "object": "` + p1 + `"}`
+	if status := deliver(t, keys, remote, p1+"/inbox", follow); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if followers := ti.getActivity(t, "/person/P1/follower"); followers["totalItems"] != 1.0 {
+		t.Fatal(followers)
+	}
+	// The embedded follow has to be of the actor of the Undo
+	forged := `{"type": "Undo", "actor": "` + remote + `", "object": {"type": "Follow", "actor": "` + p2 + `", "object": "` + p1 + `"}}`
+	if status := deliver(t, keys, remote, p1+"/inbox", forged); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+	undo := `{"type": "Undo", "actor": "` + remote + `", "object": ` + follow + `}`
+	if status := deliver(t, keys, remote, p1+"/inbox", undo); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if followers := ti.getActivity(t, "/person/P1/follower"); followers["totalItems"] != 0.0 {
+		t.Fatal(followers)
+	}
+}
@@ -5,13 +5,13 @@ go 1.18
 require (
 	github.com/dyne/Zenroom/bindings/golang/zenroom v0.0.0-20221011162848-b675846b230e
 	github.com/gin-contrib/cors v1.4.0
+	github.com/gin-contrib/sse v0.1.0
 	github.com/gin-gonic/gin v1.8.2
 	github.com/go-fed/activity v1.0.0
 	github.com/tarantool/go-tarantool v1.10.0
 )
 
 require (
-	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.0 // indirect
 	github.com/go-playground/universal-translator v0.18.0 // indirect
 	github.com/go-playground/validator/v10 v10.11.1 // indirect
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP Signatures (draft-cavage-http-signatures) as used by Mastodon and the
+// other ActivityPub servers. Each local actor has its own RSA key, stored in
+// the storage and published as publicKey in the actor document.
+
+var ErrBadHttpSignature = errors.New("Invalid HTTP signature")
+
+// Headers covered by the signature of the outgoing requests, the requests
+// without body (GETs) have no digest
+const SIGNED_HEADERS = "(request-target) host date digest"
+const SIGNED_HEADERS_NO_BODY = "(request-target) host date"
+
+// Remote public keys (and inboxes) are kept for this long
+const REMOTE_KEY_TTL = time.Hour
+
+const RSA_KEY_BITS = 2048
+
+// Parsed keys of the local actors and public keys of the remote ones
+type KeyRing struct {
+	storage Storage
+
+	mu         sync.Mutex
+	local      map[string]*rsa.PrivateKey
+	remote     map[string]remoteKey
+	inboxes    map[string]remoteInbox
+	httpClient *http.Client
+}
+
+// Where the activities for a remote actor are posted
+type remoteInbox struct {
+	inbox   string
+	expires time.Time
+}
+
+type remoteKey struct {
+	owner   string
+	key     *rsa.PublicKey
+	expires time.Time
+}
+
+func NewKeyRing(storage Storage) *KeyRing {
+	return &KeyRing{
+		storage:    storage,
+		local:      make(map[string]*rsa.PrivateKey),
+		remote:     make(map[string]remoteKey),
+		inboxes:    make(map[string]remoteInbox),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func generateActorKey() (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, RSA_KEY_BITS)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// Returns the private key of a local actor, it is created the first time
+func (keys *KeyRing) privateKey(actor string) (*rsa.PrivateKey, error) {
+	keys.mu.Lock()
+	key, ok := keys.local[actor]
+	keys.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	privatePem, err := keys.storage.actorKey(actor, generateActorKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(privatePem))
+	if block == nil {
+		return nil, errors.New("Could not decode the key of " + actor)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok = parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The key of " + actor + " is not an RSA key")
+	}
+
+	keys.mu.Lock()
+	keys.local[actor] = key
+	keys.mu.Unlock()
+	return key, nil
+}
+
+// Returns the publicKey property of the document of a local actor
+func (keys *KeyRing) publicKeyDocument(actor string) (map[string]interface{}, error) {
+	key, err := keys.privateKey(actor)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":           actor + "#main-key",
+		"owner":        actor,
+		"publicKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}, nil
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + b64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Builds the string that is signed, headers is the list of the names of the
+// signed headers
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		h = strings.ToLower(h)
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s",
+				strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines = append(lines, "host: "+host)
+		default:
+			value := r.Header.Get(h)
+			if value == "" {
+				return "", fmt.Errorf("%w: missing header %s", ErrBadHttpSignature, h)
+			}
+			lines = append(lines, h+": "+value)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Posts the activity to a remote inbox, signing the request with the key of
+// the local actor
+func (keys *KeyRing) post(actor string, target string, body []byte) (*http.Response, error) {
+	r, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/activity+json")
+	if err := keys.sign(actor, r, body); err != nil {
+		return nil, err
+	}
+	return keys.httpClient.Do(r)
+}
+
+// Signs the request with the key of the local actor, body is nil if the
+// request has none
+func (keys *KeyRing) sign(actor string, r *http.Request, body []byte) error {
+	key, err := keys.privateKey(actor)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	signed := SIGNED_HEADERS_NO_BODY
+	if body != nil {
+		r.Header.Set("Digest", digest(body))
+		signed = SIGNED_HEADERS
+	}
+
+	toSign, err := signingString(r, strings.Split(signed, " "))
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(toSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		actor, signed, b64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// Parses the Signature header: keyId="...",algorithm="...",...
+func parseSignatureHeader(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+// Fetches an ActivityPub document, the documents served by older versions of
+// the inbox are wrapped in {"success": ..., "data": ...}
+func (keys *KeyRing) fetchDocument(id string) (map[string]interface{}, error) {
+	r, err := http.NewRequest("GET", id, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Accept", "application/activity+json")
+	resp, err := keys.httpClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRemoteUnavailable, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w: status %d fetching %s", ErrRemoteUnavailable, resp.StatusCode, id)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	if data, ok := doc["data"].(map[string]interface{}); ok {
+		if _, wrapped := doc["success"]; wrapped {
+			return data, nil
+		}
+	}
+	return doc, nil
+}
+
+// Returns the inbox of an actor, or of the actor the object is attributed to
+func (keys *KeyRing) actorInbox(id string) (string, error) {
+	doc, err := keys.fetchDocument(id)
+	if err != nil {
+		return "", err
+	}
+	if inbox, ok := doc["inbox"].(string); ok {
+		return inbox, nil
+	}
+	if owner, ok := doc["attributedTo"].(string); ok && owner != id {
+		owner, err := keys.fetchDocument(owner)
+		if err != nil {
+			return "", err
+		}
+		if inbox, ok := owner["inbox"].(string); ok {
+			return inbox, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no inbox", id)
+}
+
+// Returns the inbox the activities for an actor are posted to: the shared
+// inbox of its server if it has one, otherwise its own inbox
+func (keys *KeyRing) deliveryInbox(actor string) (string, error) {
+	keys.mu.Lock()
+	cached, ok := keys.inboxes[actor]
+	keys.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.inbox, nil
+	}
+
+	doc, err := keys.fetchDocument(actor)
+	if err != nil {
+		return "", err
+	}
+	inbox, _ := doc["inbox"].(string)
+	if endpoints, ok := doc["endpoints"].(map[string]interface{}); ok {
+		if shared, ok := endpoints["sharedInbox"].(string); ok && shared != "" {
+			inbox = shared
+		}
+	}
+	if inbox == "" {
+		return "", fmt.Errorf("%s has no inbox", actor)
+	}
+
+	keys.mu.Lock()
+	keys.inboxes[actor] = remoteInbox{inbox: inbox, expires: time.Now().Add(REMOTE_KEY_TTL)}
+	keys.mu.Unlock()
+	return inbox, nil
+}
+
+// Returns the public key with the given keyId and the actor that owns it
+func (keys *KeyRing) publicKey(keyId string, refresh bool) (*rsa.PublicKey, string, error) {
+	keys.mu.Lock()
+	cached, ok := keys.remote[keyId]
+	keys.mu.Unlock()
+	if ok && !refresh && time.Now().Before(cached.expires) {
+		return cached.key, cached.owner, nil
+	}
+
+	docUrl, err := url.Parse(keyId)
+	if err != nil {
+		return nil, "", err
+	}
+	docUrl.Fragment = ""
+	doc, err := keys.fetchDocument(docUrl.String())
+	if err != nil {
+		return nil, "", err
+	}
+	// The document is either the actor or the key itself
+	keyDoc, ok := doc["publicKey"].(map[string]interface{})
+	if !ok {
+		keyDoc = doc
+	}
+	if id, _ := keyDoc["id"].(string); id != keyId {
+		return nil, "", fmt.Errorf("%w: key %s not found", ErrBadHttpSignature, keyId)
+	}
+	owner, _ := keyDoc["owner"].(string)
+	if owner == "" {
+		return nil, "", fmt.Errorf("%w: key %s has no owner", ErrBadHttpSignature, keyId)
+	}
+	// Anyone can publish a key naming another actor as its owner: it is
+	// accepted only if it is in the document of the owner
+	if id, _ := doc["id"].(string); owner != docUrl.String() || id != owner {
+		ownerDoc, err := keys.fetchDocument(owner)
+		if err != nil {
+			return nil, "", err
+		}
+		if !publishesKey(ownerDoc, keyId) {
+			return nil, "", fmt.Errorf("%w: key %s is not published by %s", ErrBadHttpSignature, keyId, owner)
+		}
+	}
+	publicPem, _ := keyDoc["publicKeyPem"].(string)
+	block, _ := pem.Decode([]byte(publicPem))
+	if block == nil {
+		return nil, "", fmt.Errorf("%w: could not decode key %s", ErrBadHttpSignature, keyId)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: key %s is not an RSA key", ErrBadHttpSignature, keyId)
+	}
+
+	keys.mu.Lock()
+	keys.remote[keyId] = remoteKey{owner: owner, key: key, expires: time.Now().Add(REMOTE_KEY_TTL)}
+	keys.mu.Unlock()
+	return key, owner, nil
+}
+
+// Whether the publicKey of the actor document, a key or a list of keys, has
+// the given id
+func publishesKey(doc map[string]interface{}, keyId string) bool {
+	published, ok := doc["publicKey"].([]interface{})
+	if !ok {
+		published = []interface{}{doc["publicKey"]}
+	}
+	for _, key := range published {
+		switch key := key.(type) {
+		case string:
+			if key == keyId {
+				return true
+			}
+		case map[string]interface{}:
+			if id, _ := key["id"].(string); id == keyId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verifies the HTTP signature of a request received by an inbox and returns
+// the actor that signed it. The Date header has to be within maxAge and the
+// Digest has to match the body, the GETs have neither body nor Digest.
+func (keys *KeyRing) verify(r *http.Request, body []byte, maxAge time.Duration) (string, error) {
+	params := parseSignatureHeader(r.Header.Get("Signature"))
+	keyId, signature := params["keyId"], params["signature"]
+	if keyId == "" || signature == "" {
+		return "", fmt.Errorf("%w: missing Signature header", ErrBadHttpSignature)
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "rsa-sha256" && algorithm != "hs2019" {
+		return "", fmt.Errorf("%w: unsupported algorithm %s", ErrBadHttpSignature, algorithm)
+	}
+	headers := strings.Fields(params["headers"])
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	required := map[string]bool{"(request-target)": false, "host": false, "date": false}
+	if r.Method != http.MethodGet {
+		required["digest"] = false
+	}
+	for _, h := range headers {
+		if _, ok := required[strings.ToLower(h)]; ok {
+			required[strings.ToLower(h)] = true
+		}
+	}
+	for h, signed := range required {
+		if !signed {
+			return "", fmt.Errorf("%w: header %s is not signed", ErrBadHttpSignature, h)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadHttpSignature, err.Error())
+	}
+	if age := time.Since(date); age > maxAge || age < -maxAge {
+		return "", fmt.Errorf("%w: %s", ErrBadHttpSignature, ErrStaleRequest.Error())
+	}
+	if _, ok := required["digest"]; ok && r.Header.Get("Digest") != digest(body) {
+		return "", fmt.Errorf("%w: digest does not match the body", ErrBadHttpSignature)
+	}
+
+	toVerify, err := signingString(r, headers)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := b64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrBadHttpSignature, err.Error())
+	}
+	hashed := sha256.Sum256([]byte(toVerify))
+
+	// If the verification fails with the cached key, the actor could have
+	// changed it
+	for _, refresh := range []bool{false, true} {
+		key, owner, err := keys.publicKey(keyId, refresh)
+		if err != nil {
+			return "", err
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], decoded) == nil {
+			return owner, nil
+		}
+	}
+	return "", ErrBadHttpSignature
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Replaces the body of the POST requests after they are signed
+type tamperTransport struct {
+	body []byte
+}
+
+func (tamper tamperTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "POST" {
+		r.Body = io.NopCloser(bytes.NewReader(tamper.body))
+		r.ContentLength = int64(len(tamper.body))
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Posts the activity to target, signed by actor, and returns the status
+func deliver(t *testing.T, keys *KeyRing, actor string, target string, activity string) int {
+	t.Helper()
+	resp, err := keys.post(actor, target, []byte(activity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSignedDelivery(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2"
+
+	create := `{"type": "Create", "actor": "` + p1 + `", "to": ["` + p2 + `"], "object": {"type": "Note", "content": "hi"}}`
+	if status := deliver(t, ti.keys, p1, p2+"/inbox", create); status >= 300 {
+		t.Fatal(status)
+	}
+	page, err := ti.storage.read(ReadQuery{Receiver: "P2"})
+	if err != nil || len(page.Messages) != 1 {
+		t.Fatal(page, err)
+	}
+
+	// Signed by an actor, on behalf of another one
+	forged := `{"type": "Create", "actor": "` + ti.server.URL + `/person/P3", "object": {"type": "Note", "content": "hi"}}`
+	if status := deliver(t, ti.keys, p1, p2+"/inbox", forged); status != http.StatusForbidden {
+		t.Fatal(status)
+	}
+}
+
+func TestTamperedDelivery(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2"
+
+	keys := NewKeyRing(ti.storage)
+	keys.httpClient = &http.Client{Transport: tamperTransport{
+		body: []byte(`{"type": "Create", "actor": "` + p1 + `", "object": {"type": "Note", "content": "changed"}}`),
+	}}
+	create := `{"type": "Create", "actor": "` + p1 + `", "object": {"type": "Note", "content": "hi"}}`
+	if status := deliver(t, keys, p1, p2+"/inbox", create); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if page, err := ti.storage.read(ReadQuery{Receiver: "P2"}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+}
+
+// Server of another instance, its actors sign with the keys of keys and it
+// serves the documents returned by documents
+func newTestRemote(t *testing.T, documents func(url string, path string) map[string]interface{}) (*httptest.Server, *KeyRing) {
+	storage := &MemStorage{}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc := documents(server.URL, r.URL.Path)
+		if doc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ACTIVITY_CONTENT_TYPE)
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(server.Close)
+	return server, NewKeyRing(storage)
+}
+
+func TestForgedKeyOwner(t *testing.T) {
+	ti := newTestInbox(t)
+	p1, p2 := ti.server.URL+"/person/P1", ti.server.URL+"/person/P2"
+
+	// The key of the attacker says it is of P1, whose document does not
+	// have it
+	var keys *KeyRing
+	attacker, keys := newTestRemote(t, func(url string, path string) map[string]interface{} {
+		doc, err := keys.publicKeyDocument(url + path)
+		if err != nil {
+			return nil
+		}
+		doc["owner"] = p1
+		return doc
+	})
+	follow := `{"type": "Follow", "actor": "` + p1 + `", "object": "` + p2 + `"}`
+	if status := deliver(t, keys, attacker.URL+"/key", p2+"/inbox", follow); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+	if followers, err := ti.storage.findActorFollows(p2, false); err != nil || len(followers) != 0 {
+		t.Fatal(followers, err)
+	}
+}
+
+func TestSeparateKeyDocument(t *testing.T) {
+	ti := newTestInbox(t)
+	p2 := ti.server.URL + "/person/P2"
+
+	// The actor lists the key, which is served at its own url
+	var keys *KeyRing
+	remote, keys := newTestRemote(t, func(url string, path string) map[string]interface{} {
+		switch path {
+		case "/actor":
+			return map[string]interface{}{
+				"id":        url + "/actor",
+				"type":      "Person",
+				"inbox":     url + "/actor/inbox",
+				"publicKey": []interface{}{url + "/key#main-key"},
+			}
+		case "/key":
+			doc, err := keys.publicKeyDocument(url + "/key")
+			if err != nil {
+				return nil
+			}
+			doc["owner"] = url + "/actor"
+			return doc
+		}
+		return nil
+	})
+	create := `{"type": "Create", "actor": "` + remote.URL + `/actor", "to": ["` + p2 + `"], "object": {"type": "Note", "content": "hi"}}`
+	if status := deliver(t, keys, remote.URL+"/key", p2+"/inbox", create); status >= 300 {
+		t.Fatal(status)
+	}
+	if page, err := ti.storage.read(ReadQuery{Receiver: "P2"}); err != nil || len(page.Messages) != 1 {
+		t.Fatal(page, err)
+	}
+}
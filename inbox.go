@@ -1,18 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	_ "embed"
-	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
-	"bytes"
 	"errors"
 	"strings"
 )
@@ -24,35 +26,115 @@ type Config struct {
 	ttUser string
 	ttPass string
 	zfUrl  string
+	// Storage backend, either "tarantool" (default) or "memory"
+	storage string
+	// How often the events for the subscribers are read from the storage
+	eventsPollInterval time.Duration
+	// Public keys of the agents are cached for pubkeyCacheTtl, unknown
+	// agents for pubkeyCacheNegativeTtl
+	pubkeyCacheSize        int
+	pubkeyCacheTtl         time.Duration
+	pubkeyCacheNegativeTtl time.Duration
+	// Maximum age of a signed request
+	replayWindow time.Duration
+	// Federation deliveries
+	deliveryWorkers      int
+	deliveryPerHost      int
+	deliveryMaxAttempts  int
+	deliveryPollInterval time.Duration
+	// Token of the admin endpoints, they are disabled if it is empty
+	adminToken string
+	// Messages older than retention are deleted, they are kept forever if
+	// it is zero
+	retention      time.Duration
+	expiryInterval time.Duration
 }
 
 type Message struct {
 	Sender    string                 `json:"sender"`
 	Receivers []string               `json:"receivers"`
 	Content   map[string]interface{} `json:"content"`
+	// If true the message is delivered to all the receivers or to none
+	Atomic bool `json:"atomic"`
+	// The thread of the message, by default the one of the message it
+	// replies to, if neither is set the message starts a new thread
+	ThreadId  *int `json:"thread_id"`
+	InReplyTo *int `json:"in_reply_to"`
+	// The message is deleted after Ttl seconds or at ExpiresAt, the
+	// earliest, by default it is kept until the retention of the instance
+	Ttl       int        `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
 type Storage interface {
-	send(Message) (int, error)
-	read(string, bool) ([]ReadAll, error)
+	send(Message) (SendResult, error)
+	read(ReadQuery) (ReadPage, error)
 	set(string, int, bool) error
 	countUnread(string) (int, error)
 	delete(string, int) error
+	expireMessages(time.Time, *time.Time, int) (int, error)
 
 	actorLikes(Activity) (uint64, error)
 	findActorLike(uint64) (*Activity, error)
 	findActorLikes(string) ([]uint64, error)
+	removeLike(uint64) (bool, error)
+	objectLikes(string, int) (LikesPage, error)
+	findObjectLike(string, string) (uint64, bool, error)
 
 	storeFollower(Activity, bool) (bool, uint64, error)
 	acceptFollower(uint64) error
+	rejectFollower(uint64) error
+	removeFollower(string, string) (bool, error)
+	pendingFollowers(string) ([]FollowRequest, error)
+	followPolicy(string) (string, error)
+	setFollowPolicy(string, string) error
 
+	findActorFollow(uint64) (*Activity, error)
 	findActorFollows(string, bool) ([]string, error)
+	countActorFollows(string, bool) (int, error)
+
+	events(uint64, int) ([]Event, error)
+	receiverEvents(string, uint64, int) ([]Event, error)
+	lastEventId() (uint64, error)
+
+	storeNonce(string, string, time.Time) (bool, error)
+
+	actorKey(string, func() (string, error)) (string, error)
+
+	enqueueDelivery(QueuedDelivery) (uint64, error)
+	claimDeliveries(time.Time, int, time.Duration) ([]QueuedDelivery, error)
+	deliverySucceeded(uint64) error
+	deliveryFailed(uint64, string, time.Time, bool) error
+	retryDelivery(uint64) error
+	removeDelivery(uint64) error
+	listDeliveries(string, int) ([]QueuedDelivery, error)
+
+	nextActivityId() (uint64, error)
+	storeActivity(StoredActivity) error
+	outbox(string, uint64, int) (ActivityPage, error)
+	findActivity(uint64) (*StoredActivity, error)
+	storeDirect(StoredActivity) error
+	findDirect(uint64) (*StoredActivity, error)
+
+	storeReceived(StoredActivity) (uint64, error)
+	received(string, uint64, int) (ActivityPage, error)
+	findReceived(string, string) (uint64, bool, error)
+
+	messageThread(string, int) (int, error)
+	threads(ThreadsQuery) (ThreadsPage, error)
+	thread(ThreadQuery) (ReadPage, error)
 }
 
 type Inbox struct {
 	storage       Storage
 	zfUrl         string
 	zenflowsAgent ZenflowsAgent
+	hub           *Hub
+	pubkeys       *PubkeyCache
+	replay        *ReplayGuard
+	keys          *KeyRing
+	deliveries    *DeliveryQueue
+	adminToken    string
 }
 
 func CORS() gin.HandlerFunc {
@@ -79,54 +161,99 @@ func (inbox *Inbox) sendHandler(c *gin.Context) {
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer c.JSON(http.StatusOK, result)
+	defer respondJSON(c, result)
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		result["error"] = "Could not read the body of the request"
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "Could not read the body of the request: %w", err))
 		return
 	}
-	zenroomData := ZenroomData{
-		Gql:            b64.StdEncoding.EncodeToString(body),
-		EdDSASignature: c.Request.Header.Get("zenflows-sign"),
-	}
 
 	// Read a message object, I need the receivers
 	var message Message
 	err = json.Unmarshal(body, &message)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
 	if len(message.Receivers) == 0 {
-		result["error"] = "No receivers"
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "No receivers"))
 		return
 	}
 
 	if len(message.Content) == 0 {
-		result["error"] = "Empty content"
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "Empty content"))
 		return
 	}
-	err = zenroomData.requestPublicKey(inbox.zfUrl, message.Sender)
-	if err != nil {
-		result["error"] = err.Error()
+
+	if err := message.setExpiry(time.Now()); err != nil {
+		setError(result, err)
 		return
 	}
-	err = zenroomData.isAuth()
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), message.Sender)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	// For each receiver put the message in the inbox
-	count, err := inbox.storage.send(message)
-	if err != nil {
-		result["error"] = err.Error()
+	if err := inbox.messageThread(&message); err != nil {
+		setError(result, err)
 		return
 	}
+
+	// The receivers on other servers get a direct note
+	local, remote := splitReceivers(message.Receivers)
+	outcomes, rejected := remoteOutcomes(remote)
+	if message.Atomic && rejected {
+		for _, receiver := range local {
+			outcomes = append(outcomes, Delivery{receiver, DELIVERY_ABORTED})
+		}
+		setQueued(outcomes, DELIVERY_ABORTED)
+		setError(result, ErrSendAborted)
+		result["receivers"] = outcomes
+		return
+	}
+
+	// The deliveries to the remote receivers are held until the message is
+	// stored for the local ones, an atomic send reaches all of them or none
+	held, err := inbox.sendRemote(message, outcomes)
+	if err != nil {
+		inbox.deliveries.cancel(held)
+		if message.Atomic {
+			setError(result, fmt.Errorf("Could not deliver the message: %w", err))
+			return
+		}
+		log.Printf("Could not queue the message of %s: %s\n", message.Sender, err.Error())
+		setQueued(outcomes, DELIVERY_REJECTED)
+		held = nil
+	}
+
+	// For each receiver put the message in the inbox, the sender keeps it in
+	// its threads also if all the receivers are on other servers
+	var sent SendResult
+	if len(local) > 0 || len(held) > 0 {
+		message.Receivers = local
+		sent, err = inbox.storage.send(message)
+		if err != nil {
+			inbox.deliveries.cancel(held)
+			setError(result, err)
+			if errors.Is(err, ErrSendAborted) {
+				setQueued(outcomes, DELIVERY_ABORTED)
+				result["receivers"] = append(sent.Receivers, outcomes...)
+			}
+			return
+		}
+	}
+	if err := inbox.deliveries.release(held); err != nil {
+		// The message is stored, an admin can retry the held deliveries
+		log.Printf("Could not release the deliveries of the message of %s: %s\n", message.Sender, err.Error())
+	}
+	sent.Receivers = append(sent.Receivers, outcomes...)
 	result["success"] = true
-	result["count"] = count
+	result["count"] = sent.delivered()
+	result["receivers"] = sent.Receivers
 	return
 }
 
@@ -134,6 +261,13 @@ type ReadMessages struct {
 	RequestId  int    `json:"request_id"`
 	Receiver   string `json:"receiver"`
 	OnlyUnread bool   `json:"only_unread"`
+	Limit      int    `json:"limit"`
+	Cursor     *int   `json:"cursor"`
+	// Either "asc" (default) or "desc"
+	Order string `json:"order"`
+	// Only the messages created in [since, until)
+	Since *time.Time `json:"since"`
+	Until *time.Time `json:"until"`
 }
 
 func (inbox *Inbox) readHandler(c *gin.Context) {
@@ -141,44 +275,52 @@ func (inbox *Inbox) readHandler(c *gin.Context) {
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer c.JSON(http.StatusOK, result)
+	defer respondJSON(c, result)
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	// Verify signature request
-	zenroomData := ZenroomData{
-		Gql:            b64.StdEncoding.EncodeToString(body),
-		EdDSASignature: c.Request.Header.Get("zenflows-sign"),
-	}
 	var readMessage ReadMessages
 	err = json.Unmarshal(body, &readMessage)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = zenroomData.requestPublicKey(inbox.zfUrl, readMessage.Receiver)
-	if err != nil {
-		result["error"] = err.Error()
+	if readMessage.Order != "" && readMessage.Order != "asc" && readMessage.Order != "desc" {
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "Unknown order: %s", readMessage.Order))
 		return
 	}
-	err = zenroomData.isAuth()
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), readMessage.Receiver)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	messages, err := inbox.storage.read(readMessage.Receiver, readMessage.OnlyUnread)
+	page, err := inbox.storage.read(ReadQuery{
+		Receiver:   readMessage.Receiver,
+		OnlyUnread: readMessage.OnlyUnread,
+		Cursor:     readMessage.Cursor,
+		Limit:      readMessage.Limit,
+		Desc:       readMessage.Order == "desc",
+		Since:      readMessage.Since,
+		Until:      readMessage.Until,
+	})
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
+	if len(page.Missing) > 0 {
+		log.Printf("Messages %v of %s not found\n", page.Missing, readMessage.Receiver)
+		result["missing"] = page.Missing
+	}
 
 	result["success"] = true
 	result["request_id"] = readMessage.RequestId
-	result["messages"] = messages
+	result["messages"] = page.Messages
+	result["next_cursor"] = page.NextCursor
 	return
 }
 
@@ -193,38 +335,29 @@ func (inbox *Inbox) setHandler(c *gin.Context) {
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer c.JSON(http.StatusOK, result)
+	defer respondJSON(c, result)
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	// Verify signature request
-	zenroomData := ZenroomData{
-		Gql:            b64.StdEncoding.EncodeToString(body),
-		EdDSASignature: c.Request.Header.Get("zenflows-sign"),
-	}
 	var setMessage SetMessage
 	err = json.Unmarshal(body, &setMessage)
 	if err != nil {
-		result["error"] = err.Error()
-		return
-	}
-	err = zenroomData.requestPublicKey(inbox.zfUrl, setMessage.Receiver)
-	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = zenroomData.isAuth()
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), setMessage.Receiver)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 	err = inbox.storage.set(setMessage.Receiver, setMessage.MessageId, setMessage.Read)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
@@ -241,38 +374,29 @@ func (inbox *Inbox) countHandler(c *gin.Context) {
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer c.JSON(http.StatusOK, result)
+	defer respondJSON(c, result)
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	// Verify signature request
-	zenroomData := ZenroomData{
-		Gql:            b64.StdEncoding.EncodeToString(body),
-		EdDSASignature: c.Request.Header.Get("zenflows-sign"),
-	}
 	var countMessages CountMessages
 	err = json.Unmarshal(body, &countMessages)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = zenroomData.requestPublicKey(inbox.zfUrl, countMessages.Receiver)
-	if err != nil {
-		result["error"] = err.Error()
-		return
-	}
-	err = zenroomData.isAuth()
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), countMessages.Receiver)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 	count, err := inbox.storage.countUnread(countMessages.Receiver)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
@@ -291,52 +415,205 @@ func (inbox *Inbox) deleteHandler(c *gin.Context) {
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer c.JSON(http.StatusOK, result)
+	defer respondJSON(c, result)
 
 	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	// Verify signature request
-	zenroomData := ZenroomData{
-		Gql:            b64.StdEncoding.EncodeToString(body),
-		EdDSASignature: c.Request.Header.Get("zenflows-sign"),
-	}
 	var deleteMessage DeleteMessage
 	err = json.Unmarshal(body, &deleteMessage)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = zenroomData.requestPublicKey(inbox.zfUrl, deleteMessage.Receiver)
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), deleteMessage.Receiver)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = zenroomData.isAuth()
+	err = inbox.storage.delete(deleteMessage.Receiver, deleteMessage.MessageId)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
-	err = inbox.storage.delete(deleteMessage.Receiver, deleteMessage.MessageId)
+
+	result["success"] = true
+	return
+}
+
+type Subscribe struct {
+	Receiver string `json:"receiver"`
+	// Events after this one are sent before the new ones, it can also be
+	// passed in the header Last-Event-ID
+	LastEventId *uint64 `json:"last_event_id"`
+}
+
+// Interval between the comments sent to keep the connection open
+const HEARTBEAT_INTERVAL = 30 * time.Second
+
+// Streams the events of the receiver as Server-Sent Events, the request is
+// signed as the one to /read
+func (inbox *Inbox) subscribeHandler(c *gin.Context) {
+	// Setup json response, it is used only if the subscription fails
+	result := map[string]interface{}{
+		"success": false,
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		respondJSON(c, result)
+		return
+	}
+
+	var subscribe Subscribe
+	err = json.Unmarshal(body, &subscribe)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
+		respondJSON(c, result)
 		return
 	}
+	if lastEventId := c.Request.Header.Get("Last-Event-ID"); lastEventId != "" && subscribe.LastEventId == nil {
+		id, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			setError(result, err)
+			respondJSON(c, result)
+			return
+		}
+		subscribe.LastEventId = &id
+	}
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), subscribe.Receiver)
+	if err != nil {
+		setError(result, err)
+		respondJSON(c, result)
+		return
+	}
+
+	// Subscribe before reading the missed events, so that nothing is lost
+	ch := inbox.hub.subscribe(subscribe.Receiver)
+	defer inbox.hub.unsubscribe(subscribe.Receiver, ch)
+
+	var missed []Event
+	if subscribe.LastEventId != nil {
+		missed, err = inbox.storage.receiverEvents(subscribe.Receiver, *subscribe.LastEventId, LIMIT_MSG)
+		if err != nil {
+			setError(result, err)
+			respondJSON(c, result)
+			return
+		}
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	writeEvent := func(event Event) {
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatUint(event.Id, 10),
+			Event: event.Type,
+			Data:  event,
+		})
+		c.Writer.Flush()
+	}
+	// The hub dispatches each event once, but it could be among the missed
+	// ones. The ids are not in order, the ones sent are remembered.
+	sent := make(map[uint64]bool)
+	for _, event := range missed {
+		writeEvent(event)
+		sent[event.Id] = true
+	}
+	io.WriteString(c.Writer, ": subscribed\n\n")
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !sent[event.Id] {
+				writeEvent(event)
+			}
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+type InvalidatePubkey struct {
+	Id string `json:"id"`
+}
+
+// Replaces the cached public key of an agent, e.g. after a key rotation. The
+// request has to be signed by the agent with its new key.
+func (inbox *Inbox) invalidatePubkeyHandler(c *gin.Context) {
+	// Setup json response
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	var invalidatePubkey InvalidatePubkey
+	err = json.Unmarshal(body, &invalidatePubkey)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	if invalidatePubkey.Id == "" {
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "No id"))
+		return
+	}
+	// The signature is verified with the key just fetched from zenflows,
+	// the cached one is replaced only if the request is valid
+	pubkey, err := inbox.pubkeys.fetch(invalidatePubkey.Id)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	err = inbox.authenticateWithKey(body, c.Request.Header.Get("zenflows-sign"), invalidatePubkey.Id, pubkey)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	inbox.pubkeys.replace(invalidatePubkey.Id, pubkey)
 
 	result["success"] = true
 	return
 }
 
+// The security vocabulary defines publicKey, manuallyApprovesFollowers is an
+// extension used by Mastodon
+var ACTOR_CONTEXT = []interface{}{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+	map[string]string{
+		"manuallyApprovesFollowers": "as:manuallyApprovesFollowers",
+	},
+}
+
 func (inbox *Inbox) profileHandler(actorType string) func(*gin.Context) {
 	return func(c *gin.Context) {
 		result := map[string]interface{}{
 			"success": false,
 		}
-		defer c.JSON(http.StatusOK, result)
-		//actorType := c.Param("type")
+		defer respondActivity(c, result)
 		id := c.Param("id")
 
 		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
@@ -347,32 +624,66 @@ func (inbox *Inbox) profileHandler(actorType string) func(*gin.Context) {
 		case "person":
 			zfPerson, err := inbox.zenflowsAgent.GetPerson(id)
 			if err != nil {
-				result["error"] = err.Error()
+				setError(result, err)
 				return
 			}
 			m = map[string]interface{}{
-				"@context": "https://www.w3.org/ns/activitystreams",
+				"@context": ACTOR_CONTEXT,
 				"id":       baseUrl,
 				"name":     zfPerson.Name,
 				"inbox":    baseUrl + "/inbox",
 				"outbox":   baseUrl + "/outbox",
 				"type":     "Person",
 				"summary":  zfPerson.Note,
+				// The name in acct:<name>@<host>
+				"preferredUsername": zfPerson.User,
+			}
+			if zfPerson.User == "" {
+				m["preferredUsername"] = id
 			}
 		case "economicresource":
+			zfResource, err := inbox.zenflowsAgent.GetEconomicResource(id)
+			if err != nil {
+				setError(result, err)
+				return
+			}
 			m = map[string]interface{}{
-				"@context": "https://www.w3.org/ns/activitystreams",
-				"id":       baseUrl,
-				"name":     "er",
-				"summary":  "er",
-				//"type":     "EconomicResource",
+				"@context":          ACTOR_CONTEXT,
+				"id":                baseUrl,
+				"name":              zfResource.Name,
+				"inbox":             baseUrl + "/inbox",
+				"outbox":            baseUrl + "/outbox",
+				"type":              "Service",
+				"summary":           zfResource.Note,
+				"preferredUsername": id,
 			}
 		default:
 			result["success"] = false
-			result["error"] = "Unknown actor type: " + actorType
+			setError(result, apiErrorf(CODE_NOT_FOUND, "Unknown actor type: %s", actorType))
 			return
 		}
 
+		publicKey, err := inbox.keys.publicKeyDocument(baseUrl)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		m["publicKey"] = publicKey
+		m["followers"] = baseUrl + "/follower"
+		m["following"] = baseUrl + "/following"
+		m["liked"] = baseUrl + "/liked"
+		m["likes"] = baseUrl + "/likes"
+		m["endpoints"] = map[string]string{
+			"sharedInbox": os.Getenv("BASE_URL") + "/inbox",
+		}
+
+		policy, err := inbox.storage.followPolicy(baseUrl)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		m["manuallyApprovesFollowers"] = policy != FOLLOW_POLICY_AUTO
+
 		result["data"] = m
 		result["success"] = true
 	}
@@ -385,6 +696,94 @@ type Activity struct {
 	Actor   string `json:"actor"`
 	Object  string `json:"object"`
 	Summary string `json:"summary"`
+	// The object when it is an activity itself (e.g. in Undo), Object
+	// is its id
+	Embedded *Activity `json:"-"`
+}
+
+// The object can be either the id or the whole object
+func (activity *Activity) UnmarshalJSON(data []byte) error {
+	type plain Activity
+	var raw struct {
+		plain
+		Context json.RawMessage `json:"@context"`
+		Object  json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*activity = Activity(raw.plain)
+	// Other servers often use a list of contexts
+	if err := json.Unmarshal(raw.Context, &activity.Context); err != nil && len(raw.Context) > 0 {
+		activity.Context = "https://www.w3.org/ns/activitystreams"
+	}
+	object := bytes.TrimSpace(raw.Object)
+	if len(object) == 0 || string(object) == "null" {
+		return nil
+	}
+	if object[0] == '{' {
+		var embedded Activity
+		if err := json.Unmarshal(object, &embedded); err != nil {
+			return err
+		}
+		activity.Embedded = &embedded
+		activity.Object = embedded.Id
+		return nil
+	}
+	return json.Unmarshal(object, &activity.Object)
+}
+
+func (activity Activity) MarshalJSON() ([]byte, error) {
+	type plain Activity
+	if activity.Embedded == nil {
+		return json.Marshal(plain(activity))
+	}
+	return json.Marshal(struct {
+		plain
+		Object *Activity `json:"object"`
+	}{plain(activity), activity.Embedded})
+}
+
+// Finds an activity of the local actor baseUrl, given its id, and returns
+// it with its code in the storage
+func (inbox *Inbox) findOwnActivity(baseUrl string, id string) (*Activity, uint64, error) {
+	var find func(uint64) (*Activity, error)
+	var codStr string
+	if strings.HasPrefix(id, baseUrl+"/liked/") {
+		find = inbox.storage.findActorLike
+		codStr = strings.TrimPrefix(id, baseUrl+"/liked/")
+	} else if strings.HasPrefix(id, baseUrl+"/follower/") {
+		find = inbox.storage.findActorFollow
+		codStr = strings.TrimPrefix(id, baseUrl+"/follower/")
+	} else {
+		return nil, 0, apiErrorf(CODE_NOT_FOUND, "Unknown activity %s", id)
+	}
+	cod, err := strconv.ParseUint(codStr, 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	activity, err := find(cod)
+	if err != nil {
+		return nil, 0, err
+	}
+	if activity.Actor != baseUrl {
+		return nil, 0, apiErrorf(CODE_NOT_FOUND, "Unknown activity %s", id)
+	}
+	activity.Id = id
+	return activity, cod, nil
+}
+
+// Returns the agent that acts on behalf of a local actor: the person itself
+// or the primary accountable of the economic resource
+func (inbox *Inbox) actorOwner(actorType string, id string) (string, error) {
+	if actorType != "economicresource" {
+		return id, nil
+	}
+	zfResource, err := inbox.zenflowsAgent.GetEconomicResource(id)
+	if err != nil {
+		return "", err
+	}
+	return zfResource.PrimaryAccountable.Id, nil
 }
 
 // Takes as input an object like
@@ -394,202 +793,521 @@ type Activity struct {
 //		"type": "Follow",
 //		"actor": `${url}/person/062TE0H7591KJCVT3DDEMDBF0R`,
 //		"object": `${url}/person/062TE0YPJD392CS1DPV9XWMDXC`,
-//		"published": "2014-09-30T12:34:56Z"
+//		"published": "2014-09-30T12:34:56Z",
+//		"timestamp": 1675344896000,
+//		"nonce": "..."
 //	}
-func (inbox *Inbox) outboxPostHandler(c *gin.Context) {
-	result := map[string]interface{}{
-		"success": false,
-	}
-	defer c.JSON(http.StatusOK, result)
+//
+// or a Create whose object is a Note (see createNote), signed (in the header
+// zenflows-sign) by the person of the outbox or, for an economic resource, by
+// its primary accountable
+func (inbox *Inbox) outboxPostHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondJSON(c, result)
 
-	body, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		result["error"] = err.Error()
-		return
-	}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			setError(result, err)
+			return
+		}
 
-	id := c.Param("id")
+		id := c.Param("id")
 
-	var activity Activity
-	if err := json.Unmarshal(body, &activity); err != nil {
-		result["error"] = err.Error()
-		return
-	}
+		var activity Activity
+		if err := json.Unmarshal(body, &activity); err != nil {
+			setError(result, err)
+			return
+		}
 
-	baseUrl := fmt.Sprintf("%s/person/%s", os.Getenv("BASE_URL"), id)
-	/*zfPerson, err := inbox.zenflowsAgent.GetPerson(id)
-	if err != nil {
-		result["error"] = err.Error()
-		return
-	}*/
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
 
-	switch activity.Type {
-	case "Like":
-		cod, err := inbox.storage.actorLikes(activity)
+		signer, err := inbox.actorOwner(actorType, id)
 		if err != nil {
-			result["error"] = err.Error()
+			setError(result, err)
 			return
 		}
-
-		activity.Id = fmt.Sprintf("%s/liked/%d", baseUrl, cod)
-
-		var jsonmap map[string]interface{}
-		tmp, _ := json.Marshal(activity)
-		json.Unmarshal(tmp, &jsonmap)
-
-		result["success"] = true
-		result["result"] = activity
-	case "Follow":
-		if _, cod, err := inbox.storage.storeFollower(activity, false); err != nil {
-			result["error"] = err.Error()
+		// Only the owner can post to the outbox, on behalf of the actor
+		err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), signer)
+		if err != nil {
+			setError(result, err)
 			return
-		} else {
-			activity.Id = fmt.Sprintf("%s/follower/%d", activity.Actor, cod)
+		}
+		if activity.Actor != baseUrl {
+			setError(result, apiErrorf(CODE_FORBIDDEN, "The actor has to be %s", baseUrl))
+			return
+		}
 
-			tmp, _ := json.Marshal(activity)
+		// Every activity is stored in the outbox, those that do not have
+		// an id of their own are identified by their place in the outbox
+		outboxId, err := inbox.storage.nextActivityId()
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		outboxActivityId := fmt.Sprintf("%s/outbox/%d", baseUrl, outboxId)
+		// The JSON of the activity as it is stored, if it is not activity
+		var stored []byte
+
+		switch activity.Type {
+		case "Like":
+			// A like is counted once, liking again returns the first one
+			cod, found, err := inbox.storage.findObjectLike(activity.Actor, activity.Object)
+			if err != nil {
+				setError(result, err)
+				return
+			}
+			if found {
+				activity.Id = fmt.Sprintf("%s/liked/%d", baseUrl, cod)
+				result["success"] = true
+				result["result"] = activity
+				return
+			}
+			cod, err = inbox.storage.actorLikes(activity)
+			if err != nil {
+				setError(result, err)
+				return
+			}
 
-			otherInbox := fmt.Sprintf("%s/inbox", activity.Object)
-			log.Printf("[APUB] Send follow request to %s\n", otherInbox)
+			activity.Id = fmt.Sprintf("%s/liked/%d", baseUrl, cod)
 
-			// TODO: delete stored follow request if the POST fails
-			if resp, err := http.Post(otherInbox, "application/json", bytes.NewReader(tmp)); err != nil {
-				result["error"] = errors.New("Could not deliver follow request")
+			var jsonmap map[string]interface{}
+			tmp, _ := json.Marshal(activity)
+			json.Unmarshal(tmp, &jsonmap)
+
+			result["success"] = true
+			result["result"] = activity
+
+			// The like of a remote object goes to its owner, if we can find
+			// it, the local objects already count it
+			if !isLocalObject(activity.Object) {
+				otherInbox, err := inbox.keys.actorInbox(activity.Object)
+				if err != nil {
+					log.Printf("[APUB] No inbox for %s: %s\n", activity.Object, err.Error())
+					break
+				}
+				log.Printf("[APUB] Send like to %s\n", otherInbox)
+				deliveryId, err := inbox.deliveries.enqueue(activity.Actor, otherInbox, tmp)
+				if err != nil {
+					setError(result, fmt.Errorf("Could not deliver like: %w", err))
+					return
+				}
+				result["delivery"] = deliveryId
+			}
+		case "Follow":
+			if _, cod, err := inbox.storage.storeFollower(activity, false); err != nil {
+				setError(result, err)
+				return
+			} else {
+				activity.Id = fmt.Sprintf("%s/follower/%d", activity.Actor, cod)
+
+				tmp, _ := json.Marshal(activity)
+
+				otherInbox := fmt.Sprintf("%s/inbox", activity.Object)
+				log.Printf("[APUB] Send follow request to %s\n", otherInbox)
+
+				// If the delivery fails for good the follow is removed
+				deliveryId, err := inbox.deliveries.enqueue(activity.Actor, otherInbox, tmp)
+				if err != nil {
+					setError(result, fmt.Errorf("Could not deliver follow request: %w", err))
+					return
+				}
+				result["data"] = activity
+				result["delivery"] = deliveryId
+			}
+		case "Update":
+			// The followers are notified of the changes of the actor
+			if activity.Object == "" {
+				activity.Object = baseUrl
+			} else if activity.Object != baseUrl {
+				setError(result, apiErrorf(CODE_FORBIDDEN, "Only %s can be updated", baseUrl))
+				return
+			}
+			activity.Context = "https://www.w3.org/ns/activitystreams"
+			activity.Id = outboxActivityId
+			tmp, _ := json.Marshal(activity)
+			deliveryIds, err := inbox.deliveries.toFollowers(baseUrl, tmp)
+			if err != nil {
+				setError(result, fmt.Errorf("Could not deliver update: %w", err))
+				return
+			}
+			result["data"] = activity
+			result["deliveries"] = deliveryIds
+		case "Create":
+			create, addressed, blind, err := createNote(baseUrl, outboxId, body)
+			if err != nil {
+				setError(result, err)
+				return
+			}
+			recipients, err := inbox.recipients(baseUrl, addressed)
+			if err != nil {
+				setError(result, err)
+				return
+			}
+			// The blind recipients can be the public or the followers too,
+			// the actors that get the note anyway are left out
+			blindRecipients, err := inbox.recipients(baseUrl, blind)
+			if err != nil {
+				setError(result, err)
+				return
+			}
+			addressedTo := make(map[string]bool)
+			for _, recipient := range recipients {
+				addressedTo[recipient] = true
+			}
+			blind = []string{}
+			for _, recipient := range blindRecipients {
+				if !addressedTo[recipient] {
+					blind = append(blind, recipient)
+				}
+			}
+			stored, _ = json.Marshal(create)
+			log.Printf("[APUB] Send note to %d actors\n", len(recipients)+len(blind))
+			deliveryIds, err := inbox.deliveries.fanOut(baseUrl, recipients, stored, true)
+			if err != nil {
+				setError(result, fmt.Errorf("Could not deliver note: %w", err))
+				return
+			}
+			// A shared inbox would not know the blind recipients
+			blindIds, err := inbox.deliveries.fanOut(baseUrl, blind, stored, false)
+			if err != nil {
+				setError(result, fmt.Errorf("Could not deliver note: %w", err))
 				return
-			} else if resp.StatusCode != 200 {
-				result["error"] = errors.New("Non-200 status when follow request was sent")
+			}
+			result["data"] = create
+			result["deliveries"] = append(deliveryIds, blindIds...)
+		case "Undo":
+			undone, cod, err := inbox.findOwnActivity(baseUrl, activity.Object)
+			if err != nil {
+				setError(result, err)
 				return
 			}
+			var otherInbox string
+			switch undone.Type {
+			case "Like":
+				if _, err := inbox.storage.removeLike(cod); err != nil {
+					setError(result, err)
+					return
+				}
+				// The undo goes to whoever owns the liked object, if we can
+				// find it
+				otherInbox, err = inbox.keys.actorInbox(undone.Object)
+				if err != nil {
+					log.Printf("[APUB] No inbox for %s: %s\n", undone.Object, err.Error())
+				}
+			case "Follow":
+				if _, err := inbox.storage.removeFollower(undone.Actor, undone.Object); err != nil {
+					setError(result, err)
+					return
+				}
+				otherInbox = fmt.Sprintf("%s/inbox", undone.Object)
+			}
+			activity.Context = "https://www.w3.org/ns/activitystreams"
+			activity.Id = outboxActivityId
+			activity.Embedded = undone
 			result["data"] = activity
+
+			if otherInbox != "" {
+				tmp, _ := json.Marshal(activity)
+				log.Printf("[APUB] Send undo to %s\n", otherInbox)
+				deliveryId, err := inbox.deliveries.enqueue(activity.Actor, otherInbox, tmp)
+				if err != nil {
+					setError(result, fmt.Errorf("Could not deliver undo: %w", err))
+					return
+				}
+				result["delivery"] = deliveryId
+			}
+
+		default:
+			setError(result, apiErrorf(CODE_BAD_REQUEST, "Unknown activity type"))
+			return
 		}
 
-	default:
-		result["error"] = "Unknown activity type"
+		if stored == nil {
+			if activity.Context == "" {
+				activity.Context = "https://www.w3.org/ns/activitystreams"
+			}
+			stored, _ = json.Marshal(activity)
+		}
+		err = inbox.storage.storeActivity(StoredActivity{
+			Id:       outboxId,
+			Actor:    baseUrl,
+			Type:     activity.Type,
+			Activity: string(stored),
+			Created:  time.Now(),
+		})
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		result["success"] = true
+	}
+}
+
+// Reads an activity delivered to an inbox, which has to be signed by its
+// actor
+func (inbox *Inbox) deliveredActivity(r *http.Request) (Activity, []byte, error) {
+	var activity Activity
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return activity, nil, apiErrorf(CODE_BAD_REQUEST, "Could not read the body of the request: %w", err)
 	}
-	result["success"] = true
 
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return activity, nil, err
+	}
+	if activity.Type == "" || activity.Actor == "" {
+		return activity, nil, apiErrorf(CODE_BAD_REQUEST, "The activity has to have a type and an actor")
+	}
+
+	// Only the actor of the activity can deliver it
+	signer, err := inbox.keys.verify(r, body, inbox.replay.window)
+	if err != nil {
+		return activity, nil, err
+	}
+	if signer != activity.Actor {
+		return activity, nil, apiErrorf(CODE_FORBIDDEN, "Activity of %s signed by %s", activity.Actor, signer)
+	}
+	return activity, body, nil
 }
 
 func (inbox *Inbox) inboxPostHandler(c *gin.Context) {
-	status := http.StatusInternalServerError
 	result := map[string]interface{}{
 		"success": false,
 	}
-	defer func() {
-		c.JSON(status, result)
-	}()
+	defer respondJSON(c, result)
 
-	body, err := io.ReadAll(c.Request.Body)
+	activity, body, err := inbox.deliveredActivity(c.Request)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}
 
-	id := c.Param("id")
-	actorType := c.Param("type")
-
-	var activity Activity
-	if err := json.Unmarshal(body, &activity); err != nil {
-		result["error"] = err.Error()
-		return
-	}
+	inbox.receive(c.Param("type"), c.Param("id"), activity, body, result)
+}
 
+// Handles an activity received by the local actor id, whose signature has
+// already been verified
+func (inbox *Inbox) receive(actorType string, id string, activity Activity, body []byte, result map[string]interface{}) {
 	baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+	// An activity delivered again (e.g. retried after a timeout) is handled
+	// once
+	if activity.Id != "" {
+		receivedId, found, err := inbox.storage.findReceived(baseUrl, activity.Id)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		if found {
+			log.Printf("[APUB] %s already received\n", activity.Id)
+			result["success"] = true
+			result["data"] = activity
+			result["received"] = receivedId
+			return
+		}
+	}
 	/*zfPerson, err := inbox.zenflowsAgent.GetPerson(id)
 	if err != nil {
-		result["error"] = err.Error()
+		setError(result, err)
 		return
 	}*/
 
 	switch activity.Type {
 	case "Follow":
-		if _, _, err := inbox.storage.storeFollower(activity, true); err != nil {
-			result["error"] = err.Error()
+		if activity.Object != baseUrl {
+			setError(result, apiErrorf(CODE_BAD_REQUEST, "Follow of %s delivered to %s", activity.Object, baseUrl))
 			return
 		}
-		acceptActivity := &Activity{
-			Context: "https://www.w3.org/ns/activitystreams",
-			Type:    "Accept",
-			Actor:   activity.Object,
-			Object:  activity.Id,
+		policy, err := inbox.storage.followPolicy(baseUrl)
+		if err != nil {
+			setError(result, err)
+			return
 		}
-		var jsonmap map[string]interface{}
-		tmp, _ := json.Marshal(acceptActivity)
-		json.Unmarshal(tmp, &jsonmap)
-
-		otherInbox := fmt.Sprintf("%s/inbox", activity.Actor)
-		log.Printf("[APUB] Send accept request to %s\n", otherInbox)
-
-		if resp, err := http.Post(otherInbox, "application/json", bytes.NewReader(tmp)); err != nil {
-			result["error"] = errors.New(fmt.Sprintf("Could not deliver follow request: %s", err.Error()))
+		_, cod, err := inbox.storage.storeFollower(activity, false)
+		if err != nil {
+			setError(result, err)
 			return
-		} else if resp.StatusCode != 200 {
-			bodyResp, err := io.ReadAll(c.Request.Body)
-			if err != nil {
-				result["error"] = err.Error()
-				return
-			}
-			log.Println("Accept error: ", bodyResp)
-			result["error"] = errors.New(fmt.Sprintf("Status when follow request was sent: %d", resp.StatusCode))
+		}
+		// With the manual policy the request waits for the approval
+		if policy == FOLLOW_POLICY_MANUAL {
+			log.Printf("[APUB] Follow request of %s is pending\n", activity.Actor)
+			result["data"] = activity
+			break
+		}
+		answer, _, err := inbox.answerFollow(baseUrl, cod, policy != FOLLOW_POLICY_DENY)
+		if err != nil {
+			setError(result, err)
 			return
 		}
-		result["data"] = acceptActivity
-	case "Accept":
-		log.Printf("[APUB] I am going to accept %s\n", activity.Object)
-		codStr := strings.TrimPrefix(activity.Object, fmt.Sprintf("%s/follower/", baseUrl))
-		cod, err := strconv.ParseUint(codStr, 10, 64)
+		result["data"] = answer
+	case "Accept", "Reject":
+		log.Printf("[APUB] %s of %s\n", activity.Type, activity.Object)
+		cod, err := inbox.answeredFollow(baseUrl, activity)
 		if err != nil {
 			log.Println("[APUB] Exit with error ", err.Error())
-			result["error"] = err.Error()
+			setError(result, err)
 			return
 		}
-		log.Printf("[APUB] Parsed id %d\n", cod)
-		if err := inbox.storage.acceptFollower(cod); err != nil {
+		if activity.Type == "Accept" {
+			err = inbox.storage.acceptFollower(cod)
+		} else {
+			err = inbox.storage.rejectFollower(cod)
+		}
+		if err != nil {
 			log.Println(err.Error())
-			result["error"] = err.Error()
+			setError(result, err)
+			return
+		}
+		result["data"] = activity
+	case "Like":
+		// The likes of the local objects are in their likes collection
+		if err := inbox.recordLike(activity); err != nil {
+			setError(result, err)
+			return
+		}
+		result["data"] = activity
+	case "Undo":
+		// Only the activities that are embedded can be undone, we do not
+		// know the ids of the remote activities
+		undone := activity.Embedded
+		if undone == nil {
+			setError(result, apiErrorf(CODE_BAD_REQUEST, "The undone activity has to be embedded"))
+			return
+		}
+		if undone.Actor != activity.Actor {
+			setError(result, apiErrorf(CODE_FORBIDDEN, "Activity of %s undone by %s", undone.Actor, activity.Actor))
+			return
+		}
+		switch undone.Type {
+		case "Follow":
+			if undone.Object != baseUrl {
+				setError(result, apiErrorf(CODE_BAD_REQUEST, "Follow of %s delivered to %s", undone.Object, baseUrl))
+				return
+			}
+			log.Printf("[APUB] %s does not follow %s anymore\n", undone.Actor, baseUrl)
+			if _, err := inbox.storage.removeFollower(undone.Actor, baseUrl); err != nil {
+				setError(result, err)
+				return
+			}
+		case "Like":
+			cod, found, err := inbox.storage.findObjectLike(undone.Actor, undone.Object)
+			if err != nil {
+				setError(result, err)
+				return
+			}
+			if found {
+				if _, err := inbox.storage.removeLike(cod); err != nil {
+					setError(result, err)
+					return
+				}
+			}
+		default:
+			setError(result, apiErrorf(CODE_BAD_REQUEST, "Unknown activity type"))
 			return
 		}
 		result["data"] = activity
-
 	default:
-		result["error"] = "Unknown activity type"
+		// The other activities (Create, Announce, Like, Update, Delete, ...)
+		// are only stored
+		result["data"] = activity
+	}
+
+	// Every valid activity is kept in the inbox of the actor
+	receivedId, err := inbox.storage.storeReceived(StoredActivity{
+		Actor:      baseUrl,
+		Type:       activity.Type,
+		Activity:   string(body),
+		Created:    time.Now(),
+		ActivityId: activity.Id,
+	})
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	if actorType == "person" {
+		bridge, err := inbox.bridged(baseUrl, activity)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		if bridge {
+			content, expiresAt := messageContent(body)
+			if _, err := inbox.storage.send(Message{
+				Sender:    activity.Actor,
+				Receivers: []string{id},
+				Content:   content,
+				ExpiresAt: expiresAt,
+			}); err != nil {
+				setError(result, err)
+				return
+			}
+		}
 	}
 
 	log.Println("Inbox finished")
-	status = http.StatusOK
 	result["success"] = true
-
+	result["received"] = receivedId
 }
 
-func (inbox *Inbox) likedHandler(c *gin.Context) {
-	result := map[string]interface{}{
-		"success": false,
+// Tells whether an activity received by a person is also a message, read
+// with /read: a Create is, updates and deletions only if they come from the
+// actors it follows. The other activities (follows, likes, announces, ...)
+// are only kept in the inbox collection.
+func (inbox *Inbox) bridged(baseUrl string, activity Activity) (bool, error) {
+	switch activity.Type {
+	case "Create":
+		return true, nil
+	case "Update", "Delete":
+		following, err := inbox.storage.findActorFollows(baseUrl, true)
+		if err != nil {
+			return false, err
+		}
+		for _, actor := range following {
+			if actor == activity.Actor {
+				return true, nil
+			}
+		}
+		log.Printf("[APUB] Ignore %s of %s\n", activity.Type, activity.Actor)
 	}
-	defer c.JSON(http.StatusOK, result)
+	return false, nil
+}
 
-	id := c.Param("id")
-	actorType := c.Param("type")
+func (inbox *Inbox) likedHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
 
-	baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+		id := c.Param("id")
 
-	likedIds, err := inbox.storage.findActorLikes(baseUrl)
-	if err != nil {
-		result["error"] = err.Error()
-		return
-	}
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
 
-	items := []string{}
-	for i := 0; i < len(likedIds); i = i + 1 {
-		likeUrl := fmt.Sprintf("%s/liked/%d", baseUrl, likedIds[i])
-		items = append(items, likeUrl)
-	}
+		likedIds, err := inbox.storage.findActorLikes(baseUrl)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+
+		items := []string{}
+		for i := 0; i < len(likedIds); i = i + 1 {
+			likeUrl := fmt.Sprintf("%s/liked/%d", baseUrl, likedIds[i])
+			items = append(items, likeUrl)
+		}
 
-	jsonmap := map[string]interface{}{
-		"@context": "https://www.w3.org/ns/activitystreams",
-		"type":     "Collection",
-		"items":    items,
+		result["success"] = true
+		if wantsActivity(c) {
+			result["data"] = orderedCollection(baseUrl+"/liked", items)
+			return
+		}
+		result["data"] = map[string]interface{}{
+			"@context": "https://www.w3.org/ns/activitystreams",
+			"type":     "Collection",
+			"items":    items,
+		}
 	}
-	result["success"] = true
-	result["data"] = jsonmap
 }
 
 func (inbox *Inbox) likedIdHandler(actorType string) func(*gin.Context) {
@@ -597,23 +1315,23 @@ func (inbox *Inbox) likedIdHandler(actorType string) func(*gin.Context) {
 		result := map[string]interface{}{
 			"success": false,
 		}
-		defer c.JSON(http.StatusOK, result)
+		defer respondActivity(c, result)
 
 		id := c.Param("id")
 		liked := c.Param("liked")
 
-		baseUrl := fmt.Sprintf("%s/person/%s", os.Getenv("BASE_URL"), id)
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
 
 		var likedId uint64 = 0
 		var err error
 		if likedId, err = strconv.ParseUint(liked, 10, 64); err != nil {
-			result["error"] = err.Error()
+			setError(result, err)
 			return
 		}
 
 		likedActivity, err := inbox.storage.findActorLike(likedId)
 		if err != nil {
-			result["error"] = err.Error()
+			setError(result, err)
 			return
 		}
 
@@ -628,61 +1346,228 @@ func (inbox *Inbox) likedIdHandler(actorType string) func(*gin.Context) {
 	}
 }
 
-func (inbox *Inbox) followHandler(follower bool) func(c *gin.Context) {
+func (inbox *Inbox) followHandler(actorType string, follower bool) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		result := map[string]interface{}{
 			"success": false,
 		}
-		defer c.JSON(http.StatusOK, result)
+		defer respondActivity(c, result)
 
 		id := c.Param("id")
-		actorType := c.Param("type")
 
 		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
 
 		ids, err := inbox.storage.findActorFollows(baseUrl, follower)
 		if err != nil {
-			result["error"] = err.Error()
+			setError(result, err)
+			return
+		}
+		// The list has at most LIMIT_MSG follows
+		total, err := inbox.storage.countActorFollows(baseUrl, follower)
+		if err != nil {
+			setError(result, err)
 			return
 		}
 
 		result["success"] = true
+		if wantsActivity(c) {
+			collectionId := baseUrl + "/follower"
+			if follower {
+				collectionId = baseUrl + "/following"
+			}
+			if ids == nil {
+				ids = []string{}
+			}
+			collection := orderedCollection(collectionId, ids)
+			collection["totalItems"] = total
+			result["data"] = collection
+			return
+		}
 		result["data"] = ids
+		result["totalItems"] = total
 	}
 }
 
-func loadEnvConfig() Config {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	return Config{
-		host:   os.Getenv("HOST"),
-		port:   port,
-		ttHost: os.Getenv("TT_HOST"),
-		ttUser: os.Getenv("TT_USER"),
-		ttPass: os.Getenv("TT_PASS"),
-		zfUrl:  fmt.Sprintf("%s/api", os.Getenv("ZENFLOWS_URL")),
+// Allows the requests with the header Authorization: Bearer <ADMIN_TOKEN>
+func (inbox *Inbox) adminAuth(c *gin.Context) {
+	if inbox.adminToken == "" {
+		abortWithError(c, apiErrorf(CODE_FORBIDDEN, "Admin endpoints are disabled"))
+		return
+	}
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(inbox.adminToken)) != 1 {
+		abortWithError(c, apiErrorf(CODE_UNAUTHORIZED, "Invalid admin token"))
+		return
 	}
+	c.Next()
 }
 
-func main() {
-	config := loadEnvConfig()
-	log.Printf("Using backend %s\n", config.zfUrl)
+// Lists the federation deliveries, by default the dead ones
+func (inbox *Inbox) listDeliveriesHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
 
-	za := ZenflowsAgent{
-		Sk:          os.Getenv("ZENFLOWS_SK"),
-		ZenflowsUrl: config.zfUrl,
+	status := c.DefaultQuery("status", DELIVERY_DEAD)
+	if status == "all" {
+		status = ""
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > LIMIT_MSG {
+		limit = LIMIT_MSG
+	}
+	deliveries, err := inbox.storage.listDeliveries(status, limit)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []QueuedDelivery{}
 	}
 
-	storage := &TTStorage{}
-	err := storage.Init(config.ttHost, config.ttUser, config.ttPass)
+	result["success"] = true
+	result["data"] = deliveries
+}
+
+// Puts a delivery (usually a dead one) back in the queue
+func (inbox *Inbox) retryDeliveryHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	id, err := strconv.ParseUint(c.Param("delivery"), 10, 64)
 	if err != nil {
-		log.Fatal(err.Error())
+		setError(result, err)
+		return
 	}
-	inbox := &Inbox{
-		storage:       storage,
-		zfUrl:         config.zfUrl,
-		zenflowsAgent: za,
+	if err := inbox.storage.retryDelivery(id); err != nil {
+		setError(result, err)
+		return
 	}
+	inbox.deliveries.notify()
+
+	result["success"] = true
+}
 
+const ACTIVITY_CONTENT_TYPE = "application/activity+json; charset=utf-8"
+
+// The other servers ask for the ActivityStreams documents, the GUI for the
+// legacy wrapped JSON
+func wantsActivity(c *gin.Context) bool {
+	accept := c.GetHeader("Accept")
+	return strings.Contains(accept, "application/activity+json") ||
+		strings.Contains(accept, "application/ld+json")
+}
+
+// Sends the result of a GET of an ActivityPub object: the bare object
+// (result["data"]) if the client asked for it, the whole result otherwise
+func respondActivity(c *gin.Context, result map[string]interface{}) {
+	c.Header("Vary", "Accept")
+	if !wantsActivity(c) || result["success"] != true {
+		respondJSON(c, result)
+		return
+	}
+	renderJSON(c, http.StatusOK, ACTIVITY_CONTENT_TYPE, result["data"])
+}
+
+func orderedCollection(id string, items []string) map[string]interface{} {
+	return map[string]interface{}{
+		"@context":     "https://www.w3.org/ns/activitystreams",
+		"id":           id,
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	}
+}
+
+// Writes data as JSON with the given content type, gin.JSON always uses
+// application/json
+func renderJSON(c *gin.Context, status int, contentType string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(status, contentType, body)
+}
+
+func loadEnvConfig() Config {
+	port, _ := strconv.Atoi(os.Getenv("PORT"))
+	eventsPollInterval, err := time.ParseDuration(os.Getenv("EVENTS_POLL_INTERVAL"))
+	if err != nil {
+		eventsPollInterval = time.Second
+	}
+	pubkeyCacheSize, err := strconv.Atoi(os.Getenv("PUBKEY_CACHE_SIZE"))
+	if err != nil {
+		pubkeyCacheSize = 1024
+	}
+	pubkeyCacheTtl, err := time.ParseDuration(os.Getenv("PUBKEY_CACHE_TTL"))
+	if err != nil {
+		pubkeyCacheTtl = 10 * time.Minute
+	}
+	pubkeyCacheNegativeTtl, err := time.ParseDuration(os.Getenv("PUBKEY_CACHE_NEGATIVE_TTL"))
+	if err != nil {
+		pubkeyCacheNegativeTtl = time.Minute
+	}
+	replayWindow, err := time.ParseDuration(os.Getenv("REPLAY_WINDOW"))
+	if err != nil {
+		replayWindow = 5 * time.Minute
+	}
+	deliveryWorkers, err := strconv.Atoi(os.Getenv("DELIVERY_WORKERS"))
+	if err != nil || deliveryWorkers <= 0 {
+		deliveryWorkers = 8
+	}
+	deliveryPerHost, err := strconv.Atoi(os.Getenv("DELIVERY_PER_HOST"))
+	if err != nil || deliveryPerHost <= 0 {
+		deliveryPerHost = 2
+	}
+	deliveryMaxAttempts, err := strconv.Atoi(os.Getenv("DELIVERY_MAX_ATTEMPTS"))
+	if err != nil || deliveryMaxAttempts <= 0 {
+		deliveryMaxAttempts = 10
+	}
+	deliveryPollInterval, err := time.ParseDuration(os.Getenv("DELIVERY_POLL_INTERVAL"))
+	if err != nil {
+		deliveryPollInterval = 5 * time.Second
+	}
+	retention, err := time.ParseDuration(os.Getenv("RETENTION"))
+	if err != nil || retention < 0 {
+		retention = 0
+	}
+	expiryInterval, err := time.ParseDuration(os.Getenv("EXPIRY_INTERVAL"))
+	if err != nil || expiryInterval <= 0 {
+		expiryInterval = time.Minute
+	}
+	return Config{
+		host:    os.Getenv("HOST"),
+		port:    port,
+		ttHost:  os.Getenv("TT_HOST"),
+		ttUser:  os.Getenv("TT_USER"),
+		ttPass:  os.Getenv("TT_PASS"),
+		zfUrl:   fmt.Sprintf("%s/api", os.Getenv("ZENFLOWS_URL")),
+		storage: os.Getenv("STORAGE"),
+
+		eventsPollInterval: eventsPollInterval,
+
+		pubkeyCacheSize:        pubkeyCacheSize,
+		pubkeyCacheTtl:         pubkeyCacheTtl,
+		pubkeyCacheNegativeTtl: pubkeyCacheNegativeTtl,
+		replayWindow:           replayWindow,
+
+		deliveryWorkers:      deliveryWorkers,
+		deliveryPerHost:      deliveryPerHost,
+		deliveryMaxAttempts:  deliveryMaxAttempts,
+		deliveryPollInterval: deliveryPollInterval,
+		adminToken:           os.Getenv("ADMIN_TOKEN"),
+
+		retention:      retention,
+		expiryInterval: expiryInterval,
+	}
+}
+
+// Routes of the service
+func (inbox *Inbox) router() *gin.Engine {
 	r := gin.Default()
 	r.SetTrustedProxies(nil)
 	r.Use(CORS())
@@ -692,20 +1577,102 @@ func main() {
 	r.POST("/set-read", inbox.setHandler)
 	r.POST("/count-unread", inbox.countHandler)
 	r.POST("/delete", inbox.deleteHandler)
-
-	// TODO: why /:type/:id didn't work????
-	r.GET("/person/:id", inbox.profileHandler("person"))
-	r.GET("/economicresource/:id", inbox.profileHandler("economicresource"))
+	r.POST("/threads", inbox.threadsHandler)
+	r.POST("/thread", inbox.threadHandler)
+	r.POST("/subscribe", inbox.subscribeHandler)
+	r.POST("/invalidate-pubkey", inbox.invalidatePubkeyHandler)
+	r.POST("/follow-policy", inbox.followPolicyHandler)
+	r.POST("/follow-requests", inbox.followRequestsHandler)
+	r.POST("/follow-requests/approve", inbox.answerFollowHandler(true))
+	r.POST("/follow-requests/reject", inbox.answerFollowHandler(false))
+
+	// Each type has its own routes, /:type/:id would conflict with them
+	for _, actorType := range []string{"person", "economicresource"} {
+		actorPath := fmt.Sprintf("/%s/:id", actorType)
+		r.GET(actorPath, inbox.profileHandler(actorType))
+		r.GET(actorPath+"/liked", inbox.likedHandler(actorType))
+		r.GET(actorPath+"/liked/:liked", inbox.likedIdHandler(actorType))
+		r.GET(actorPath+"/likes", inbox.actorLikesHandler(actorType))
+		r.GET(actorPath+"/follower", inbox.followHandler(actorType, false))
+		r.GET(actorPath+"/following", inbox.followHandler(actorType, true))
+		r.GET(actorPath+"/outbox", inbox.outboxHandler(actorType))
+		r.GET(actorPath+"/outbox/:activity", inbox.outboxActivityHandler(actorType))
+		r.POST(actorPath+"/outbox", inbox.outboxPostHandler(actorType))
+		r.GET(actorPath+"/inbox", inbox.inboxHandler(actorType))
+		r.GET(actorPath+"/note/:note", inbox.noteHandler(actorType))
+	}
 
 	r.POST("/:type/:id/inbox", inbox.inboxPostHandler)
+	r.POST("/inbox", inbox.sharedInboxHandler)
+	r.GET("/likes", inbox.likesHandler)
+
+	r.GET("/.well-known/webfinger", inbox.webfingerHandler)
+	r.GET("/.well-known/host-meta", inbox.hostMetaHandler)
+	r.GET("/.well-known/nodeinfo", inbox.nodeinfoLinksHandler)
+	r.GET("/nodeinfo/2.0", inbox.nodeinfoHandler("2.0"))
+	r.GET("/nodeinfo/2.1", inbox.nodeinfoHandler("2.1"))
+	r.GET("/openapi.json", openapiHandler)
+
+	admin := r.Group("/admin", inbox.adminAuth)
+	admin.GET("/deliveries", inbox.listDeliveriesHandler)
+	admin.POST("/deliveries/:delivery/retry", inbox.retryDeliveryHandler)
+	return r
+}
+
+func main() {
+	config := loadEnvConfig()
+	log.Printf("Using backend %s\n", config.zfUrl)
+
+	za := ZenflowsAgent{
+		Sk:          os.Getenv("ZENFLOWS_SK"),
+		ZenflowsUrl: config.zfUrl,
+	}
 
-	r.POST("/person/:id/outbox", inbox.outboxPostHandler)
-	r.GET("/:type/:id/liked", inbox.likedHandler)
-	r.GET("/person/:id/liked/:liked", inbox.likedIdHandler("person"))
-	r.GET("/economicresource/:id/liked/:liked", inbox.likedIdHandler("economicresource"))
+	var storage Storage
+	switch config.storage {
+	case "", "tarantool":
+		ttStorage := &TTStorage{}
+		if err := ttStorage.Init(config.ttHost, config.ttUser, config.ttPass); err != nil {
+			log.Fatal(err.Error())
+		}
+		storage = ttStorage
+	case "memory":
+		memStorage := &MemStorage{}
+		if err := memStorage.Init(); err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Println("Using in-memory storage, nothing will be persisted")
+		storage = memStorage
+	default:
+		log.Fatalf("Unknown storage backend: %s\n", config.storage)
+	}
+	hub, err := NewHub(storage)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	go hub.run(config.eventsPollInterval)
 
-	r.GET("/:type/:id/follower", inbox.followHandler(false))
-	r.GET("/:type/:id/following", inbox.followHandler(true))
+	inbox := &Inbox{
+		storage:       storage,
+		zfUrl:         config.zfUrl,
+		zenflowsAgent: za,
+		hub:           hub,
+		pubkeys: NewPubkeyCache(config.zfUrl, config.pubkeyCacheSize,
+			config.pubkeyCacheTtl, config.pubkeyCacheNegativeTtl),
+		replay: &ReplayGuard{
+			storage: storage,
+			window:  config.replayWindow,
+		},
+		adminToken: config.adminToken,
+	}
+	inbox.keys = NewKeyRing(storage)
+	inbox.deliveries = NewDeliveryQueue(storage, inbox.keys, config.deliveryWorkers,
+		config.deliveryPerHost, config.deliveryMaxAttempts)
+	go inbox.deliveries.run(config.deliveryPollInterval)
+	expiry := &Expiry{storage: storage, retention: config.retention}
+	go expiry.run(config.expiryInterval)
+
+	r := inbox.router()
 
 	host := fmt.Sprintf("%s:%d", config.host, config.port)
 	log.Printf("Starting service on %s\n", host)
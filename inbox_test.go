@@ -0,0 +1,302 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyne/zenflows-inbox/client"
+)
+
+func TestSendAndRead(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob := ti.client("alice"), ti.client("bob")
+
+	sent, err := alice.Send([]string{"bob", "carol", "bob", ""}, map[string]interface{}{"message": "hi"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []string{}
+	for _, delivery := range sent.Receivers {
+		statuses = append(statuses, delivery.Status)
+	}
+	if sent.Count != 2 || len(statuses) != 4 || statuses[0] != DELIVERY_DELIVERED ||
+		statuses[2] != DELIVERY_DUPLICATE || statuses[3] != DELIVERY_REJECTED {
+		t.Fatalf("Unexpected outcomes %v", sent)
+	}
+
+	page, err := bob.Read(client.ReadQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].Sender != "alice" || page.Messages[0].Read ||
+		page.Messages[0].Content["message"] != "hi" || page.NextCursor != nil {
+		t.Fatalf("Unexpected page %+v", page)
+	}
+	id := page.Messages[0].Id
+
+	if count, err := bob.CountUnread(); err != nil || count != 1 {
+		t.Fatal(count, err)
+	}
+	if err := bob.SetRead(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := bob.CountUnread(); err != nil || count != 0 {
+		t.Fatal(count, err)
+	}
+	if page, err := bob.Read(client.ReadQuery{OnlyUnread: true}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+	if err := bob.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if page, err := bob.Read(client.ReadQuery{}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+	// carol still has it
+	if page, err := ti.client("carol").Read(client.ReadQuery{}); err != nil || len(page.Messages) != 1 {
+		t.Fatal(page, err)
+	}
+}
+
+func TestReadPages(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob := ti.client("alice"), ti.client("bob")
+	for i := 0; i < 5; i++ {
+		if _, err := alice.Send([]string{"bob"}, map[string]interface{}{"n": i}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, order := range []string{"asc", "desc"} {
+		ids := []int{}
+		query := client.ReadQuery{Limit: 2, Order: order}
+		for {
+			page, err := bob.Read(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range page.Messages {
+				ids = append(ids, message.Id)
+			}
+			if page.NextCursor == nil {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if len(ids) != 5 {
+			t.Fatalf("%s: read %v", order, ids)
+		}
+		for i := 1; i < len(ids); i++ {
+			if (order == "asc") != (ids[i-1] < ids[i]) {
+				t.Fatalf("%s: wrong order %v", order, ids)
+			}
+		}
+	}
+
+	status, result := ti.post(t, "/read", signed(map[string]interface{}{"receiver": "bob", "order": "up"}))
+	if status != http.StatusBadRequest || result["code"] != CODE_BAD_REQUEST {
+		t.Fatal(status, result)
+	}
+}
+
+func TestAtomicSend(t *testing.T) {
+	ti := newTestInbox(t)
+	alice := ti.client("alice")
+
+	_, err := alice.Send([]string{"bob", ""}, map[string]interface{}{"message": "hi"}, true)
+	expectCode(t, err, http.StatusUnprocessableEntity, CODE_SEND_ABORTED)
+	if page, err := ti.client("bob").Read(client.ReadQuery{}); err != nil || len(page.Messages) != 0 {
+		t.Fatal(page, err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ti := newTestInbox(t)
+	ti.zenflows.setUnknown("nobody")
+
+	_, err := ti.client("nobody").Read(client.ReadQuery{})
+	expectCode(t, err, http.StatusUnauthorized, CODE_UNKNOWN_AGENT)
+	// The unknown agent is cached too
+	_, err = ti.client("nobody").Read(client.ReadQuery{})
+	expectCode(t, err, http.StatusUnauthorized, CODE_UNKNOWN_AGENT)
+	ti.zenflows.mu.Lock()
+	requests := ti.zenflows.pubkeyRequests
+	ti.zenflows.mu.Unlock()
+	if requests != 1 {
+		t.Fatal(requests)
+	}
+
+	other := client.New(ti.server.URL, "bob", TEST_OTHER_SK)
+	_, err = other.Read(client.ReadQuery{})
+	expectCode(t, err, http.StatusUnauthorized, CODE_BAD_SIGNATURE)
+
+	status, result := ti.do(t, "POST", "/read", []byte(`{"receiver": "bob"}`), nil)
+	if status != http.StatusUnauthorized || result["code"] != CODE_BAD_SIGNATURE {
+		t.Fatal(status, result)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ti := newTestInbox(t)
+
+	request := signed(map[string]interface{}{"receiver": "bob"})
+	if status, result := ti.post(t, "/read", request); status != http.StatusOK {
+		t.Fatal(status, result)
+	}
+	if status, result := ti.post(t, "/read", request); status != http.StatusUnauthorized || result["code"] != CODE_REPLAYED_REQUEST {
+		t.Fatal(status, result)
+	}
+
+	stale := signed(map[string]interface{}{"receiver": "bob"})
+	stale["timestamp"] = time.Now().Add(-time.Hour).UnixMilli()
+	if status, result := ti.post(t, "/read", stale); status != http.StatusUnauthorized || result["code"] != CODE_STALE_REQUEST {
+		t.Fatal(status, result)
+	}
+	if status, result := ti.post(t, "/read", map[string]interface{}{"receiver": "bob"}); status != http.StatusUnauthorized || result["code"] != CODE_STALE_REQUEST {
+		t.Fatal(status, result)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	ti := newTestInbox(t)
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"POST", "/send", "{", http.StatusBadRequest, CODE_BAD_REQUEST},
+		{"POST", "/send", `{"sender": "alice", "receivers": [], "content": {"a": 1}}`, http.StatusBadRequest, CODE_BAD_REQUEST},
+		{"POST", "/send", `{"sender": "alice", "receivers": ["bob"], "content": {}}`, http.StatusBadRequest, CODE_BAD_REQUEST},
+		{"GET", "/admin/deliveries", "", http.StatusUnauthorized, CODE_UNAUTHORIZED},
+		{"GET", "/.well-known/webfinger", "", http.StatusBadRequest, CODE_BAD_REQUEST},
+		{"GET", "/.well-known/webfinger?resource=acct:alice@example.org", "", http.StatusNotFound, CODE_NOT_FOUND},
+		{"GET", "/person/alice/outbox/99", "", http.StatusNotFound, CODE_NOT_FOUND},
+		{"POST", "/person/alice/inbox", `{"type": "Follow", "actor": "http://example.org/a"}`, http.StatusUnauthorized, CODE_BAD_SIGNATURE},
+	}
+	for _, c := range cases {
+		status, result := ti.do(t, c.method, c.path, []byte(c.body), nil)
+		if status != c.status || result["code"] != c.code {
+			t.Errorf("%s %s: %d %v", c.method, c.path, status, result)
+		}
+	}
+}
+
+func TestOpenapi(t *testing.T) {
+	ti := newTestInbox(t)
+	status, result := ti.do(t, "GET", "/openapi.json", nil, nil)
+	if status != http.StatusOK || result["openapi"] == nil {
+		t.Fatal(status)
+	}
+	paths, _ := result["paths"].(map[string]interface{})
+	// The routes of each actor type are documented once, as /{type}
+	actorTypes := map[string]bool{}
+	components, _ := result["components"].(map[string]interface{})
+	parameters, _ := components["parameters"].(map[string]interface{})
+	actorType, _ := parameters["ActorType"].(map[string]interface{})
+	schema, _ := actorType["schema"].(map[string]interface{})
+	enum, _ := schema["enum"].([]interface{})
+	for _, name := range enum {
+		actorTypes[name.(string)] = true
+	}
+
+	// Every route is documented, with the parameters as {param}
+	param := regexp.MustCompile(`:([a-z_]+)`)
+	for _, route := range ti.router().Routes() {
+		path := param.ReplaceAllString(route.Path, "{$1}")
+		if segments := strings.SplitN(path, "/", 3); len(segments) > 1 && actorTypes[segments[1]] {
+			segments[1] = "{type}"
+			path = strings.Join(segments, "/")
+		}
+		operations, _ := paths[path].(map[string]interface{})
+		if operations[strings.ToLower(route.Method)] == nil {
+			t.Errorf("%s %s is not documented", route.Method, path)
+		}
+	}
+}
+
+func TestInvalidatePubkey(t *testing.T) {
+	ti := newTestInbox(t)
+	bob := ti.client("bob")
+	rotated := client.New(ti.server.URL, "bob", TEST_OTHER_SK)
+	requests := func() int {
+		ti.zenflows.mu.Lock()
+		defer ti.zenflows.mu.Unlock()
+		return ti.zenflows.pubkeyRequests
+	}
+
+	if _, err := bob.Read(client.ReadQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	ti.zenflows.setPubkey("bob", TEST_OTHER_PK)
+
+	// Signed with the old key: the cached key stays
+	err := bob.InvalidatePubkey()
+	expectCode(t, err, http.StatusUnauthorized, CODE_BAD_SIGNATURE)
+	if _, err := bob.Read(client.ReadQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests(); n != 2 {
+		t.Fatalf("%d requests of the public key", n)
+	}
+
+	// Signed with the new key: it replaces the cached one
+	if err := rotated.InvalidatePubkey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Read(client.ReadQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.Read(client.ReadQuery{})
+	expectCode(t, err, http.StatusUnauthorized, CODE_BAD_SIGNATURE)
+	if n := requests(); n != 3 {
+		t.Fatalf("%d requests of the public key", n)
+	}
+}
+
+func TestReceivedActivities(t *testing.T) {
+	ti := newTestInbox(t)
+	p1 := ti.server.URL + "/person/P1"
+	remote, keys := newTestSigningActor(t)
+	receive := func(activity string) {
+		t.Helper()
+		if status := deliver(t, keys, remote, p1+"/inbox", activity); status != http.StatusOK {
+			t.Fatal(status, activity)
+		}
+	}
+	messages := func() int {
+		t.Helper()
+		page, err := ti.storage.read(ReadQuery{Receiver: "P1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page.Messages)
+	}
+
+	// A Create delivered again is stored and read once
+	create := `{"id": "` + remote + `/create/1", "type": "Create", "actor": "` + remote + `", "to": ["` + p1 + `"], "object": {"type": "Note", "content": "hi"}}`
+	receive(create)
+	receive(create)
+	if n := messages(); n != 1 {
+		t.Fatal(n)
+	}
+	// Likes, announces and the updates of the actors P1 does not follow are
+	// not messages
+	receive(`{"id": "` + remote + `/like/1", "type": "Like", "actor": "` + remote + `", "object": "` + p1 + `"}`)
+	receive(`{"type": "Announce", "actor": "` + remote + `", "object": "` + remote + `/note/1"}`)
+	receive(`{"type": "Update", "actor": "` + remote + `", "object": "` + remote + `"}`)
+	if n := messages(); n != 1 {
+		t.Fatal(n)
+	}
+	collection, err := ti.client("P1").Inbox("person", "P1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := collection["orderedItems"].([]interface{}); len(items) != 4 {
+		t.Fatal(collection)
+	}
+}
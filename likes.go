@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Likes of an object, the oldest first, and the number of all its likes.
+// Cods are the codes of the likes in the storage.
+type LikesPage struct {
+	Likes []Activity
+	Cods  []uint64
+	Total int
+}
+
+func isLocalObject(object string) bool {
+	return strings.HasPrefix(object, os.Getenv("BASE_URL")+"/")
+}
+
+// Builds the likes collection of an object: the Like activities (whose
+// actors are the ones that liked it) and their number
+func (inbox *Inbox) likesCollection(collectionId string, object string) (map[string]interface{}, error) {
+	page, err := inbox.storage.objectLikes(object, LIMIT_MSG)
+	if err != nil {
+		return nil, err
+	}
+	items := []interface{}{}
+	for i, like := range page.Likes {
+		// The likes of the local actors are identified by their place in
+		// the liked collection
+		if like.Id == "" {
+			like.Id = fmt.Sprintf("%s/liked/%d", like.Actor, page.Cods[i])
+		}
+		var item map[string]interface{}
+		tmp, _ := json.Marshal(like)
+		json.Unmarshal(tmp, &item)
+		delete(item, "@context")
+		items = append(items, item)
+	}
+	return map[string]interface{}{
+		"@context":     "https://www.w3.org/ns/activitystreams",
+		"id":           collectionId,
+		"type":         "OrderedCollection",
+		"totalItems":   page.Total,
+		"orderedItems": items,
+	}, nil
+}
+
+// The likes of any object, given its url in the query (?object=<url>)
+func (inbox *Inbox) likesHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondActivity(c, result)
+
+	object := c.Query("object")
+	if object == "" {
+		setError(result, apiErrorf(CODE_BAD_REQUEST, "No object"))
+		return
+	}
+	collectionId := fmt.Sprintf("%s/likes?object=%s", os.Getenv("BASE_URL"), url.QueryEscape(object))
+	data, err := inbox.likesCollection(collectionId, object)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	result["success"] = true
+	result["data"] = data
+}
+
+// The likes of a local actor, e.g. of an economic resource
+func (inbox *Inbox) actorLikesHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
+
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, c.Param("id"))
+		data, err := inbox.likesCollection(baseUrl+"/likes", baseUrl)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		result["success"] = true
+		result["data"] = data
+	}
+}
+
+// Records a Like received from another server, if its object is local and
+// it is not already recorded
+func (inbox *Inbox) recordLike(activity Activity) error {
+	if !isLocalObject(activity.Object) {
+		return nil
+	}
+	if _, found, err := inbox.storage.findObjectLike(activity.Actor, activity.Object); err != nil || found {
+		return err
+	}
+	_, err := inbox.storage.actorLikes(activity)
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestLikes(t *testing.T) {
+	ti := newTestInbox(t)
+	object := ti.client("alice").ActorUrl("person", "carol")
+
+	like := func(agent string) string {
+		t.Helper()
+		actor := ti.client(agent).ActorUrl("person", agent)
+		result, err := ti.client(agent).PostActivity("person", agent, map[string]interface{}{
+			"type": "Like", "actor": actor, "object": object,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result["result"].(map[string]interface{})["id"].(string)
+	}
+	first := like("alice")
+	// Liking again returns the same like, which is counted once
+	if again := like("alice"); again != first {
+		t.Fatal(first, again)
+	}
+	like("bob")
+
+	likes := ti.getActivity(t, "/person/carol/likes")
+	items, _ := likes["orderedItems"].([]interface{})
+	if likes["totalItems"] != 2.0 || len(items) != 2 || likes["id"] != object+"/likes" ||
+		items[0].(map[string]interface{})["id"] != first {
+		t.Fatal(likes)
+	}
+	likes = ti.getActivity(t, "/likes?object="+url.QueryEscape(object))
+	if likes["totalItems"] != 2.0 {
+		t.Fatal(likes)
+	}
+	liked := ti.getActivity(t, "/person/alice/liked")
+	if items, _ := liked["orderedItems"].([]interface{}); len(items) != 1 {
+		t.Fatal(liked)
+	}
+	if likes := ti.getActivity(t, "/person/bob/likes"); likes["totalItems"] != 0.0 {
+		t.Fatal(likes)
+	}
+}
+
+func TestUndoLike(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, carol := ti.server.URL+"/person/alice", ti.server.URL+"/person/carol"
+	result, err := ti.client("alice").PostActivity("person", "alice", map[string]interface{}{
+		"type": "Like", "actor": alice, "object": carol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	likeId := result["result"].(map[string]interface{})["id"].(string)
+
+	// The Undo goes to the owner of the liked object, here carol herself
+	if _, err := ti.client("alice").PostActivity("person", "alice", map[string]interface{}{
+		"type": "Undo", "actor": alice, "object": likeId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ti.deliveriesOf(t, "Undo", carol+"/inbox")) != 1 {
+		t.Fatal(ti.deliveries(t, ""))
+	}
+	if liked := ti.getActivity(t, "/person/alice/liked"); liked["totalItems"] != 0.0 {
+		t.Fatal(liked)
+	}
+	if likes := ti.getActivity(t, "/person/carol/likes"); likes["totalItems"] != 0.0 {
+		t.Fatal(likes)
+	}
+	// Only the actor of the like can undo it
+	_, err = ti.client("bob").PostActivity("person", "bob", map[string]interface{}{
+		"type": "Undo", "actor": ti.server.URL + "/person/bob", "object": likeId,
+	})
+	expectCode(t, err, http.StatusNotFound, CODE_NOT_FOUND)
+
+	// A remote actor likes carol and then takes it back
+	remote, keys := newTestSigningActor(t)
+	like := `{"type": "Like", "actor": "` + remote + `", "object": "` + carol + `"}`
+	if status := deliver(t, keys, remote, carol+"/inbox", like); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if likes := ti.getActivity(t, "/person/carol/likes"); likes["totalItems"] != 1.0 {
+		t.Fatal(likes)
+	}
+	undo := `{"type": "Undo", "actor": "` + remote + `", "object": ` + like + `}`
+	if status := deliver(t, keys, remote, carol+"/inbox", undo); status != http.StatusOK {
+		t.Fatal(status)
+	}
+	if likes := ti.getActivity(t, "/person/carol/likes"); likes["totalItems"] != 0.0 {
+		t.Fatal(likes)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dyne/zenflows-inbox/client"
+	"github.com/gin-gonic/gin"
+)
+
+// EdDSA key pair of the agents of the tests, and another one
+const (
+	TEST_SK       = "CMZkoX14iviTWWuDNezrCksLMBt2gLxfQCViC5urxuJ3"
+	TEST_PK       = "GFA54GhuVyhEVn24DsuLtozxD33U89EchbWebm3Eeqai"
+	TEST_OTHER_SK = "3zc1g8LDnnvDjaovj1Rmz8jweRh1HQpum2QXqYRAsfoE"
+	TEST_OTHER_PK = "Hy6HrcJt7HUNnTFF2GhatVzyef8ptZqHXGKL6aSX12BQ"
+)
+
+// Answers the queries of the inbox as zenflows does, every agent has the
+// public key TEST_PK unless it is in pubkeys
+type testZenflows struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Agents that zenflows does not know
+	unknown map[string]bool
+	pubkeys map[string]string
+	// Economic resources and their primary accountable
+	resources map[string]string
+	// Usernames of the agents, by default the username is the id
+	users map[string]string
+	// zenflows does not answer
+	down bool
+	// Number of the public keys requested
+	pubkeyRequests int
+}
+
+func newTestZenflows(t *testing.T) *testZenflows {
+	zf := &testZenflows{
+		unknown:   make(map[string]bool),
+		pubkeys:   make(map[string]string),
+		resources: make(map[string]string),
+		users:     make(map[string]string),
+	}
+	zf.server = httptest.NewServer(http.HandlerFunc(zf.handle))
+	t.Cleanup(zf.server.Close)
+	return zf
+}
+
+func (zf *testZenflows) setUnknown(id string) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.unknown[id] = true
+}
+
+func (zf *testZenflows) setPubkey(id string, pubkey string) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.pubkeys[id] = pubkey
+}
+
+func (zf *testZenflows) setResource(id string, owner string) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.resources[id] = owner
+}
+
+func (zf *testZenflows) setUser(id string, user string) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.users[id] = user
+}
+
+func (zf *testZenflows) setDown(down bool) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.down = down
+}
+
+// Returns the username of the agent id
+func (zf *testZenflows) user(id string) string {
+	if user, ok := zf.users[id]; ok {
+		return user
+	}
+	return id
+}
+
+func (zf *testZenflows) handle(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query     string            `json:"query"`
+		Variables map[string]string `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	if zf.down {
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, "Bad gateway")
+		return
+	}
+
+	id := request.Variables["id"]
+	var data map[string]interface{}
+	// As zenflows, the fields of the unknown agents are null with an error
+	var errors []interface{}
+	switch request.Query {
+	case GQL_PERSON_PUBKEY:
+		zf.pubkeyRequests++
+		data = map[string]interface{}{"personPubkey": nil}
+		if zf.unknown[id] {
+			errors = append(errors, map[string]interface{}{"message": "not found", "path": []string{"personPubkey"}})
+		} else {
+			pubkey, ok := zf.pubkeys[id]
+			if !ok {
+				pubkey = TEST_PK
+			}
+			data["personPubkey"] = pubkey
+		}
+	case GQL_PERSON:
+		data = map[string]interface{}{"person": nil}
+		if zf.unknown[id] {
+			errors = append(errors, map[string]interface{}{"message": "not found", "path": []string{"person"}})
+		} else {
+			data["person"] = map[string]interface{}{"id": id, "name": "Name of " + id, "note": "", "user": zf.user(id)}
+		}
+	case GQL_PERSON_BY_USER:
+		edges := []interface{}{}
+		user := request.Variables["user"]
+		for person := range zf.users {
+			if zf.users[person] == user {
+				edges = append(edges, map[string]interface{}{
+					"node": map[string]interface{}{"id": person, "name": "Name of " + person, "note": "", "user": user},
+				})
+			}
+		}
+		if len(edges) == 0 && !zf.unknown[user] && zf.user(user) == user {
+			edges = append(edges, map[string]interface{}{
+				"node": map[string]interface{}{"id": user, "name": "Name of " + user, "note": "", "user": user},
+			})
+		}
+		data = map[string]interface{}{"people": map[string]interface{}{"edges": edges}}
+	case GQL_ECONOMIC_RESOURCE:
+		data = map[string]interface{}{"economicResource": nil}
+		if owner, ok := zf.resources[id]; ok {
+			data["economicResource"] = map[string]interface{}{
+				"id": id, "name": "Resource " + id, "note": "",
+				"primaryAccountable": map[string]interface{}{"id": owner},
+			}
+		}
+	}
+	response := map[string]interface{}{"data": data}
+	if errors != nil {
+		response["errors"] = errors
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Service with the in-memory storage, its deliveries are processed and its
+// events are polled every few milliseconds
+type testInbox struct {
+	*Inbox
+	storage  *MemStorage
+	server   *httptest.Server
+	zenflows *testZenflows
+}
+
+func newTestInbox(t *testing.T) *testInbox {
+	gin.SetMode(gin.TestMode)
+	zf := newTestZenflows(t)
+	zfUrl := zf.server.URL
+
+	storage := &MemStorage{}
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	hub, err := NewHub(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hub.run(10 * time.Millisecond)
+
+	inbox := &Inbox{
+		storage:       storage,
+		zfUrl:         zfUrl,
+		zenflowsAgent: ZenflowsAgent{Sk: TEST_SK, ZenflowsUrl: zfUrl},
+		hub:           hub,
+		pubkeys:       NewPubkeyCache(zfUrl, 16, time.Minute, time.Minute),
+		replay:        &ReplayGuard{storage: storage, window: time.Minute},
+		adminToken:    "admin",
+	}
+	inbox.keys = NewKeyRing(storage)
+	inbox.deliveries = NewDeliveryQueue(storage, inbox.keys, 4, 2, 3)
+	go inbox.deliveries.run(10 * time.Millisecond)
+
+	server := httptest.NewServer(inbox.router())
+	t.Cleanup(server.Close)
+	t.Setenv("BASE_URL", server.URL)
+	return &testInbox{inbox, storage, server, zf}
+}
+
+// Client of the agent id
+func (ti *testInbox) client(id string) *client.Client {
+	return client.New(ti.server.URL, id, TEST_SK)
+}
+
+// Posts the request, signed by an agent with TEST_SK, and returns the status
+// and the decoded response
+func (ti *testInbox) post(t *testing.T, path string, request interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ti.client("").Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti.do(t, "POST", path, body, map[string]string{"zenflows-sign": signature})
+}
+
+func (ti *testInbox) do(t *testing.T, method string, path string, body []byte, headers map[string]string) (int, map[string]interface{}) {
+	t.Helper()
+	r, err := http.NewRequest(method, ti.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("%s %s: %d %s", method, path, resp.StatusCode, out)
+	}
+	return resp.StatusCode, result
+}
+
+// Signed request fields, a new nonce each time
+var testNonce struct {
+	sync.Mutex
+	n int
+}
+
+func signed(request map[string]interface{}) map[string]interface{} {
+	testNonce.Lock()
+	testNonce.n++
+	request["nonce"] = fmt.Sprintf("nonce-%d", testNonce.n)
+	testNonce.Unlock()
+	request["timestamp"] = time.Now().UnixMilli()
+	return request
+}
+
+// Waits for cond to be true, for at most five seconds
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Condition not met in time")
+}
+
+func expectCode(t *testing.T, err error, status int, code string) {
+	t.Helper()
+	clientErr, ok := err.(*client.Error)
+	if !ok {
+		t.Fatalf("Expected error %s, got %v", code, err)
+	}
+	if clientErr.Status != status || clientErr.Code != code {
+		t.Fatalf("Expected %d %s, got %d %s: %s", status, code, clientErr.Status, clientErr.Code, clientErr.Message)
+	}
+}
+
+// Gets the ActivityPub document at path, it has to be found
+func (ti *testInbox) getActivity(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	status, doc := ti.do(t, "GET", path, nil, map[string]string{"Accept": "application/activity+json"})
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: %d %v", path, status, doc)
+	}
+	return doc
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notes published by the local actors with Create activities, they are
+// delivered to the followers and to the actors they are addressed to
+
+const AS_PUBLIC = "https://www.w3.org/ns/activitystreams#Public"
+
+// Properties with the recipients of an object
+var AUDIENCE_FIELDS = []string{"to", "cc", "bto", "bcc", "audience"}
+
+func isPublic(id string) bool {
+	return id == AS_PUBLIC || id == "as:Public" || id == "Public"
+}
+
+// Returns the ids in the property of the object, which can be either an id
+// or a list of ids
+func idList(object map[string]interface{}, property string) []string {
+	switch value := object[property].(type) {
+	case string:
+		return []string{value}
+	case []string:
+		return value
+	case []interface{}:
+		ids := []string{}
+		for _, v := range value {
+			if id, ok := v.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+// Returns the ids the object is addressed to
+func addressees(object map[string]interface{}) []string {
+	ids := []string{}
+	for _, field := range AUDIENCE_FIELDS {
+		ids = append(ids, idList(object, field)...)
+	}
+	return ids
+}
+
+// Returns the actors that receive an activity of the local actor baseUrl
+// addressed to the given ids: the followers, if it is public or addressed
+// to them, and the other actors
+func (inbox *Inbox) recipients(baseUrl string, addressed []string) ([]string, error) {
+	seen := map[string]bool{baseUrl: true}
+	recipients := []string{}
+	add := func(actor string) {
+		if !seen[actor] {
+			seen[actor] = true
+			recipients = append(recipients, actor)
+		}
+	}
+	toFollowers := false
+	for _, id := range addressed {
+		if isPublic(id) || id == baseUrl+"/follower" {
+			toFollowers = true
+			continue
+		}
+		add(id)
+	}
+	if toFollowers {
+		followers, err := inbox.storage.findActorFollows(baseUrl, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, follower := range followers {
+			add(follower)
+		}
+	}
+	return recipients, nil
+}
+
+// Completes a Create of a Note posted to the outbox of the local actor
+// baseUrl with the ids, the author and the addressing, which is copied from
+// the activity to the note and vice versa. Without addressing the note is
+// public and delivered to the followers. Returns the activity, the ids it
+// is addressed to and its blind recipients (bto and bcc).
+func createNote(baseUrl string, outboxId uint64, body []byte) (map[string]interface{}, []string, []string, error) {
+	var create map[string]interface{}
+	if err := json.Unmarshal(body, &create); err != nil {
+		return nil, nil, nil, err
+	}
+	note, ok := create["object"].(map[string]interface{})
+	if !ok || note["type"] != "Note" {
+		return nil, nil, nil, apiErrorf(CODE_BAD_REQUEST, "Only Note objects can be created")
+	}
+	// They are only needed to sign the request
+	delete(create, "timestamp")
+	delete(create, "nonce")
+
+	create["@context"] = "https://www.w3.org/ns/activitystreams"
+	create["id"] = fmt.Sprintf("%s/outbox/%d", baseUrl, outboxId)
+	note["id"] = fmt.Sprintf("%s/note/%d", baseUrl, outboxId)
+	note["attributedTo"] = baseUrl
+	if _, ok := note["published"]; !ok {
+		note["published"] = time.Now().UTC().Format(time.RFC3339)
+	}
+	create["published"] = note["published"]
+
+	if len(addressees(create)) == 0 && len(addressees(note)) == 0 {
+		create["to"] = []string{AS_PUBLIC}
+		create["cc"] = []string{baseUrl + "/follower"}
+	}
+	for _, field := range AUDIENCE_FIELDS {
+		if _, ok := create[field]; !ok && note[field] != nil {
+			create[field] = note[field]
+		} else if _, ok := note[field]; !ok && create[field] != nil {
+			note[field] = create[field]
+		}
+	}
+	// The blind recipients are not disclosed
+	blind := append(idList(create, "bto"), idList(create, "bcc")...)
+	for _, object := range []map[string]interface{}{create, note} {
+		delete(object, "bto")
+		delete(object, "bcc")
+	}
+	return create, addressees(create), blind, nil
+}
+
+// A note is the object of the Create activity with the same number in the
+// outbox
+func (inbox *Inbox) noteHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
+
+		id := c.Param("id")
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+
+		activityId, err := strconv.ParseUint(c.Param("note"), 10, 64)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		activity, err := inbox.actorActivity(c.Request, baseUrl, activityId)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		if activity.Type != "Create" {
+			setError(result, ErrActivityNotFound)
+			return
+		}
+
+		var create map[string]interface{}
+		if err := json.Unmarshal([]byte(activity.Activity), &create); err != nil {
+			setError(result, err)
+			return
+		}
+		note, ok := create["object"].(map[string]interface{})
+		if !ok {
+			setError(result, ErrActivityNotFound)
+			return
+		}
+		note["@context"] = "https://www.w3.org/ns/activitystreams"
+		result["success"] = true
+		result["data"] = note
+	}
+}
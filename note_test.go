@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Returns the targets of the deliveries of the activity with the given id
+func (ti *testInbox) targetsOf(t *testing.T, id string) map[string]int {
+	t.Helper()
+	targets := make(map[string]int)
+	for _, delivery := range ti.deliveries(t, "") {
+		var activity map[string]interface{}
+		if err := json.Unmarshal([]byte(delivery.Activity), &activity); err != nil {
+			t.Fatal(err)
+		}
+		if activity["id"] == id {
+			targets[delivery.Target]++
+		}
+	}
+	return targets
+}
+
+func TestNoteFanOut(t *testing.T) {
+	ti := newTestInbox(t)
+	p1 := ti.server.URL + "/person/P1"
+	var followers []string
+	for i := 0; i < 2; i++ {
+		follower, keys := newTestSigningActor(t)
+		follow := `{"type": "Follow", "actor": "` + follower + `", "object": "` + p1 + `"}`
+		if status := deliver(t, keys, follower, p1+"/inbox", follow); status != http.StatusOK {
+			t.Fatal(status)
+		}
+		followers = append(followers, follower)
+	}
+	other, _ := newTestSigningActor(t)
+	post := func(create map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		create["type"] = "Create"
+		create["actor"] = p1
+		result, err := ti.client("P1").PostActivity("person", "P1", create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result["data"].(map[string]interface{})
+	}
+
+	// A public note goes to the followers, the blind recipient that is a
+	// follower gets it once
+	create := post(map[string]interface{}{
+		"object": map[string]interface{}{"type": "Note", "content": "hi"},
+		"to":     []string{AS_PUBLIC},
+		"cc":     []string{p1 + "/follower"},
+		"bcc":    []string{followers[0]},
+	})
+	targets := ti.targetsOf(t, create["id"].(string))
+	if len(targets) != 2 || targets[followers[0]+"/inbox"] != 1 || targets[followers[1]+"/inbox"] != 1 {
+		t.Fatal(targets)
+	}
+	if create["bcc"] != nil || create["object"].(map[string]interface{})["bcc"] != nil {
+		t.Fatal(create)
+	}
+	note := ti.getActivity(t, strings.TrimPrefix(create["object"].(map[string]interface{})["id"].(string), ti.server.URL))
+	if note["content"] != "hi" || note["attributedTo"] != p1 {
+		t.Fatal(note)
+	}
+
+	// Without addressing the note is public
+	create = post(map[string]interface{}{
+		"object": map[string]interface{}{"type": "Note", "content": "hello"},
+	})
+	if targets := ti.targetsOf(t, create["id"].(string)); len(targets) != 2 {
+		t.Fatal(targets)
+	}
+
+	// The public and the followers can be blind recipients too, they are not
+	// inboxes
+	create = post(map[string]interface{}{
+		"object": map[string]interface{}{"type": "Note", "content": "psst"},
+		"to":     []string{other},
+		"bto":    []string{"as:Public"},
+		"bcc":    []string{p1 + "/follower"},
+	})
+	targets = ti.targetsOf(t, create["id"].(string))
+	if len(targets) != 3 || targets[other+"/inbox"] != 1 || targets[followers[0]+"/inbox"] != 1 || targets[followers[1]+"/inbox"] != 1 {
+		t.Fatal(targets)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The OpenAPI document of the routes registered in main
+//
+//go:embed openapi.json
+var OPENAPI []byte
+
+func openapiHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", OPENAPI)
+}
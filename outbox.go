@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An activity posted to the outbox of Actor, or received by Actor in its
+// inbox, Activity is its JSON
+type StoredActivity struct {
+	Id       uint64
+	Actor    string
+	Type     string
+	Activity string
+	Created  time.Time
+	// Actors a direct activity is addressed to, only they can fetch it
+	Audience []string
+	// Id of a received activity, if it has one
+	ActivityId string
+}
+
+// Activities of an outbox, the newest first, and the number of activities
+// in the whole outbox
+type ActivityPage struct {
+	Activities []StoredActivity
+	Total      int
+}
+
+var ErrActivityNotFound = errors.New("Activity not found")
+
+const OUTBOX_PAGE_SIZE = 20
+
+// Builds the OrderedCollection collectionUrl of the stored activities read
+// by load, its items are in the pages ?page=true&max_id=<id>, which contain
+// the activities older than id
+func activityCollection(c *gin.Context, collectionUrl string, load func(uint64, int) (ActivityPage, error)) (map[string]interface{}, error) {
+	var before uint64
+	if maxId := c.Query("max_id"); maxId != "" {
+		var err error
+		if before, err = strconv.ParseUint(maxId, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Query("page") == "" && before == 0 {
+		page, err := load(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"@context":   "https://www.w3.org/ns/activitystreams",
+			"id":         collectionUrl,
+			"type":       "OrderedCollection",
+			"totalItems": page.Total,
+			"first":      collectionUrl + "?page=true",
+		}, nil
+	}
+
+	// One more activity tells if there is a next page
+	page, err := load(before, OUTBOX_PAGE_SIZE+1)
+	if err != nil {
+		return nil, err
+	}
+	activities := page.Activities
+	if len(activities) > OUTBOX_PAGE_SIZE {
+		activities = activities[:OUTBOX_PAGE_SIZE]
+	}
+	items := []interface{}{}
+	for _, activity := range activities {
+		var item interface{}
+		if err := json.Unmarshal([]byte(activity.Activity), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	pageUrl := collectionUrl + "?page=true"
+	if before > 0 {
+		pageUrl = fmt.Sprintf("%s&max_id=%d", pageUrl, before)
+	}
+	data := map[string]interface{}{
+		"@context":     "https://www.w3.org/ns/activitystreams",
+		"id":           pageUrl,
+		"type":         "OrderedCollectionPage",
+		"partOf":       collectionUrl,
+		"totalItems":   page.Total,
+		"orderedItems": items,
+	}
+	if len(page.Activities) > OUTBOX_PAGE_SIZE {
+		data["next"] = fmt.Sprintf("%s?page=true&max_id=%d", collectionUrl, activities[len(activities)-1].Id)
+	}
+	return data, nil
+}
+
+// The outbox is public
+func (inbox *Inbox) outboxHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
+
+		id := c.Param("id")
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+
+		data, err := activityCollection(c, baseUrl+"/outbox", func(before uint64, limit int) (ActivityPage, error) {
+			return inbox.storage.outbox(baseUrl, before, limit)
+		})
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		result["success"] = true
+		result["data"] = data
+	}
+}
+
+// The inbox can be read only by the owner of the actor, the request is
+// signed like the others but the signature is of the path with the query,
+// which has to contain timestamp and nonce
+func (inbox *Inbox) inboxHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
+
+		id := c.Param("id")
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+
+		owner, err := inbox.actorOwner(actorType, id)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		if err := inbox.authenticateGet(c.Request, owner); err != nil {
+			setError(result, err)
+			return
+		}
+
+		data, err := activityCollection(c, baseUrl+"/inbox", func(before uint64, limit int) (ActivityPage, error) {
+			return inbox.storage.received(baseUrl, before, limit)
+		})
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		result["success"] = true
+		result["data"] = data
+	}
+}
+
+// Returns the activity of the local actor baseUrl with the given id: one of
+// its outbox or, if the request is signed by an actor it is addressed to,
+// one of its direct activities
+func (inbox *Inbox) actorActivity(r *http.Request, baseUrl string, id uint64) (*StoredActivity, error) {
+	activity, err := inbox.storage.findActivity(id)
+	if errors.Is(err, ErrActivityNotFound) {
+		activity, err = inbox.storage.findDirect(id)
+		if err != nil {
+			return nil, err
+		}
+		// The others are not told that it exists
+		signer, err := inbox.keys.verify(r, nil, inbox.replay.window)
+		if err != nil {
+			return nil, ErrActivityNotFound
+		}
+		addressed := false
+		for _, actor := range activity.Audience {
+			addressed = addressed || actor == signer
+		}
+		if !addressed {
+			return nil, ErrActivityNotFound
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if activity.Actor != baseUrl {
+		return nil, ErrActivityNotFound
+	}
+	return activity, nil
+}
+
+func (inbox *Inbox) outboxActivityHandler(actorType string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		result := map[string]interface{}{
+			"success": false,
+		}
+		defer respondActivity(c, result)
+
+		id := c.Param("id")
+		baseUrl := fmt.Sprintf("%s/%s/%s", os.Getenv("BASE_URL"), actorType, id)
+
+		activityId, err := strconv.ParseUint(c.Param("activity"), 10, 64)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+		activity, err := inbox.actorActivity(c.Request, baseUrl, activityId)
+		if err != nil {
+			setError(result, err)
+			return
+		}
+
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(activity.Activity), &data); err != nil {
+			setError(result, err)
+			return
+		}
+		result["success"] = true
+		result["data"] = data
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned (wrapped) when zenflows does not know the agent, these failures
+// are cached too
+var ErrUnknownAgent = errors.New("Unknown agent")
+
+// LRU cache of the public keys of the agents, the entries expire after ttl
+// (negativeTtl for the unknown agents)
+type PubkeyCache struct {
+	zfUrl       string
+	size        int
+	ttl         time.Duration
+	negativeTtl time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type pubkeyEntry struct {
+	id      string
+	key     string
+	err     error
+	expires time.Time
+}
+
+func NewPubkeyCache(zfUrl string, size int, ttl, negativeTtl time.Duration) *PubkeyCache {
+	return &PubkeyCache{
+		zfUrl:       zfUrl,
+		size:        size,
+		ttl:         ttl,
+		negativeTtl: negativeTtl,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+func (cache *PubkeyCache) lookup(id string) (*pubkeyEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*pubkeyEntry)
+	if time.Now().After(entry.expires) {
+		cache.lru.Remove(elem)
+		delete(cache.entries, id)
+		return nil, false
+	}
+	cache.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (cache *PubkeyCache) store(entry *pubkeyEntry) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.entries[entry.id]; ok {
+		cache.lru.Remove(elem)
+	}
+	cache.entries[entry.id] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*pubkeyEntry).id)
+	}
+}
+
+// Returns the public key of the agent, it is requested to zenflows only if
+// it is not in the cache
+func (cache *PubkeyCache) get(id string) (string, error) {
+	if entry, ok := cache.lookup(id); ok {
+		return entry.key, entry.err
+	}
+	key, err := cache.fetch(id)
+	if err == nil {
+		cache.replace(id, key)
+	} else if errors.Is(err, ErrUnknownAgent) && cache.negativeTtl > 0 {
+		cache.store(&pubkeyEntry{
+			id:      id,
+			err:     err,
+			expires: time.Now().Add(cache.negativeTtl),
+		})
+	}
+	return key, err
+}
+
+// Requests the public key of the agent to zenflows, the cache is neither
+// read nor changed
+func (cache *PubkeyCache) fetch(id string) (string, error) {
+	return fetchPublicKey(cache.zfUrl, id)
+}
+
+// Caches key as the public key of the agent, in place of the previous entry
+func (cache *PubkeyCache) replace(id string, key string) {
+	if cache.ttl <= 0 {
+		cache.invalidate(id)
+		return
+	}
+	cache.store(&pubkeyEntry{
+		id:      id,
+		key:     key,
+		expires: time.Now().Add(cache.ttl),
+	})
+}
+
+// Removes the agent from the cache
+func (cache *PubkeyCache) invalidate(id string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.entries[id]; ok {
+		cache.lru.Remove(elem)
+		delete(cache.entries, id)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrStaleRequest    = errors.New("Request is too old or in the future")
+	ErrReplayedRequest = errors.New("Request has already been received")
+)
+
+// Fields that every signed request has to contain, since they are in the
+// body they are covered by the signature
+type SignedRequest struct {
+	// Milliseconds since the epoch
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+}
+
+// Rejects the signed requests that are older than window or whose nonce has
+// already been used by the same agent
+type ReplayGuard struct {
+	storage Storage
+	window  time.Duration
+}
+
+func (guard *ReplayGuard) check(body []byte, id string) error {
+	var signed SignedRequest
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return err
+	}
+	return guard.checkSigned(signed, id)
+}
+
+func (guard *ReplayGuard) checkSigned(signed SignedRequest, id string) error {
+	if signed.Timestamp == 0 {
+		return fmt.Errorf("%w: missing timestamp", ErrStaleRequest)
+	}
+	if signed.Nonce == "" {
+		return fmt.Errorf("%w: missing nonce", ErrReplayedRequest)
+	}
+	timestamp := time.UnixMilli(signed.Timestamp)
+	if age := time.Since(timestamp); age > guard.window || age < -guard.window {
+		return ErrStaleRequest
+	}
+	// After the window the request would be stale anyway
+	stored, err := guard.storage.storeNonce(id, signed.Nonce, timestamp.Add(guard.window))
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return ErrReplayedRequest
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Splits the url of a local actor in its type and id
+func localActor(actorUrl string) (string, string, bool) {
+	path := strings.TrimPrefix(actorUrl, os.Getenv("BASE_URL")+"/")
+	if path == actorUrl {
+		return "", "", false
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "person" && parts[0] != "economicresource") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Returns the local actors that receive an activity delivered to the shared
+// inbox: the actors it is addressed to (or whose object they are) and, if it
+// is public, addressed to the followers or not addressed at all, the local
+// followers of its actor
+func (inbox *Inbox) sharedRecipients(activity Activity, body []byte) ([]string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+	addressed := addressees(object)
+
+	seen := make(map[string]bool)
+	recipients := []string{}
+	add := func(actor string) {
+		if _, _, ok := localActor(actor); ok && !seen[actor] {
+			seen[actor] = true
+			recipients = append(recipients, actor)
+		}
+	}
+	toFollowers := len(addressed) == 0
+	for _, id := range addressed {
+		// The followers collection of the actor, whatever its name
+		if isPublic(id) || strings.HasPrefix(id, activity.Actor+"/follower") {
+			toFollowers = true
+			continue
+		}
+		add(id)
+	}
+	add(activity.Object)
+	if toFollowers {
+		followers, err := inbox.storage.findActorFollows(activity.Actor, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, follower := range followers {
+			add(follower)
+		}
+	}
+	return recipients, nil
+}
+
+// The shared inbox of the server (endpoints.sharedInbox of the actors), an
+// activity delivered here is handled as if it were delivered to the inbox of
+// each local recipient. The response has the result for each of them.
+func (inbox *Inbox) sharedInboxHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	activity, body, err := inbox.deliveredActivity(c.Request)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	recipients, err := inbox.sharedRecipients(activity, body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	received := make(map[string]interface{})
+	for _, recipient := range recipients {
+		actorType, id, _ := localActor(recipient)
+		recipientResult := map[string]interface{}{
+			"success": false,
+		}
+		if inbox.receive(actorType, id, activity, body, recipientResult); recipientResult["success"] != true {
+			log.Printf("[APUB] %s of %s not received by %s: %v\n",
+				activity.Type, activity.Actor, recipient, recipientResult["error"])
+		}
+		received[recipient] = recipientResult
+	}
+
+	result["success"] = true
+	result["data"] = received
+}
@@ -0,0 +1,1008 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-memory implementation of Storage, it mirrors the spaces created by
+// db/instance.lua so that the service can run without tarantool (tests,
+// local development). Nothing is persisted.
+type MemStorage struct {
+	mu sync.Mutex
+
+	nextMessageId uint64
+	messages      map[uint64]memMessage
+	receivers     map[memReceiverKey]bool
+
+	nextLikedId uint64
+	liked       map[uint64]memLiked
+
+	nextFollowId   uint64
+	follow         map[uint64]memFollow
+	followPolicies map[string]string
+
+	nextEventId uint64
+	eventLog    []memEvent
+
+	// Expiration of the nonces of each agent
+	nonces map[memNonceKey]time.Time
+
+	actorKeys map[string]string
+
+	nextDeliveryId uint64
+	deliveries     map[uint64]QueuedDelivery
+
+	// Last reserved activity id, as the sequence activity_id
+	activitySeq uint64
+	activities  map[uint64]StoredActivity
+	// Direct activities, with ids of the same sequence
+	directs map[uint64]StoredActivity
+	// Activities received by the local actors
+	receivedSeq uint64
+	inboxes     map[uint64]StoredActivity
+}
+
+type memNonceKey struct {
+	agent string
+	nonce string
+}
+
+type memMessage struct {
+	content   map[string]interface{}
+	sender    string
+	threadId  uint64
+	inReplyTo *int
+	created   time.Time
+	expiresAt *time.Time
+}
+
+// Expired messages are not returned, even if they are still stored
+func (message memMessage) expired(now time.Time) bool {
+	return message.expiresAt != nil && !message.expiresAt.After(now)
+}
+
+func (message memMessage) readAll(id uint64, read bool) ReadAll {
+	return ReadAll{
+		Id:        int(id),
+		Sender:    message.sender,
+		Content:   message.content,
+		Read:      read,
+		ThreadId:  int(message.threadId),
+		InReplyTo: message.inReplyTo,
+		Created:   message.created,
+		ExpiresAt: message.expiresAt,
+	}
+}
+
+type memReceiverKey struct {
+	messageId uint64
+	receiver  string
+}
+
+type memLiked struct {
+	actor    string
+	object   string
+	summary  string
+	activity string
+}
+
+type memEvent struct {
+	event   Event
+	created time.Time
+}
+
+// Same as EVENTS_TTL and DELIVERIES_TTL in db/inbox.lua
+const (
+	MEM_EVENTS_TTL     = time.Hour
+	MEM_DELIVERIES_TTL = 24 * time.Hour
+)
+
+type memFollow struct {
+	follower  string
+	following string
+	accepted  bool
+	rejected  bool
+	activity  string
+}
+
+func (storage *MemStorage) Init() error {
+	storage.messages = make(map[uint64]memMessage)
+	storage.receivers = make(map[memReceiverKey]bool)
+	storage.liked = make(map[uint64]memLiked)
+	storage.follow = make(map[uint64]memFollow)
+	storage.followPolicies = make(map[string]string)
+	storage.nextEventId = 1
+	storage.nonces = make(map[memNonceKey]time.Time)
+	storage.actorKeys = make(map[string]string)
+	storage.nextDeliveryId = 1
+	storage.deliveries = make(map[uint64]QueuedDelivery)
+	storage.activities = make(map[uint64]StoredActivity)
+	storage.directs = make(map[uint64]StoredActivity)
+	storage.inboxes = make(map[uint64]StoredActivity)
+	return nil
+}
+
+// Records an event and removes the expired ones, the lock must be held
+func (storage *MemStorage) notify(receiver, eventType string, data map[string]interface{}) {
+	now := time.Now()
+	expired := 0
+	for expired < len(storage.eventLog) && now.Sub(storage.eventLog[expired].created) > MEM_EVENTS_TTL {
+		expired++
+	}
+	storage.eventLog = append(storage.eventLog[expired:], memEvent{
+		event: Event{
+			Id:       storage.nextEventId,
+			Receiver: receiver,
+			Type:     eventType,
+			Data:     data,
+		},
+		created: now,
+	})
+	storage.nextEventId++
+}
+
+func (storage *MemStorage) send(message Message) (SendResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var result SendResult
+	messageId := storage.nextMessageId
+	storage.nextMessageId++
+
+	seen := make(map[string]bool)
+	rejected := false
+	for _, receiver := range message.Receivers {
+		status := DELIVERY_DELIVERED
+		if receiver == "" {
+			status = DELIVERY_REJECTED
+			rejected = true
+		} else if seen[receiver] {
+			status = DELIVERY_DUPLICATE
+		}
+		seen[receiver] = true
+		result.Receivers = append(result.Receivers, Delivery{receiver, status})
+	}
+	if message.Atomic && rejected {
+		for i := range result.Receivers {
+			if result.Receivers[i].Status == DELIVERY_DELIVERED {
+				result.Receivers[i].Status = DELIVERY_ABORTED
+			}
+		}
+		return result, ErrSendAborted
+	}
+
+	threadId := messageId
+	if message.ThreadId != nil {
+		threadId = uint64(*message.ThreadId)
+	}
+	storage.messages[messageId] = memMessage{
+		content:   message.Content,
+		sender:    message.Sender,
+		threadId:  threadId,
+		inReplyTo: message.InReplyTo,
+		created:   time.Now(),
+		expiresAt: message.ExpiresAt,
+	}
+	for _, delivery := range result.Receivers {
+		if delivery.Status == DELIVERY_DELIVERED {
+			storage.receivers[memReceiverKey{messageId, delivery.Receiver}] = false
+			storage.notify(delivery.Receiver, EVENT_MESSAGE, map[string]interface{}{
+				"message_id": messageId,
+				"sender":     message.Sender,
+				"thread_id":  threadId,
+			})
+		}
+	}
+	result.MessageId = int(messageId)
+	return result, nil
+}
+
+// Returns the receivers of who sorted by message id
+func (storage *MemStorage) receiverKeys(who string, onlyUnread bool) []memReceiverKey {
+	var keys []memReceiverKey
+	for key, read := range storage.receivers {
+		if key.receiver != who || (onlyUnread && read) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].messageId < keys[j].messageId
+	})
+	return keys
+}
+
+func (storage *MemStorage) read(query ReadQuery) (ReadPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	page := ReadPage{Messages: make([]ReadAll, 0, 5)}
+	keys := storage.receiverKeys(query.Receiver, query.OnlyUnread)
+	if query.Desc {
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].messageId > keys[j].messageId
+		})
+	}
+	limit := query.pageSize()
+	for _, key := range keys {
+		if query.Cursor != nil {
+			cursor := uint64(*query.Cursor)
+			if (!query.Desc && key.messageId <= cursor) || (query.Desc && key.messageId >= cursor) {
+				continue
+			}
+		}
+		if len(page.Messages) == limit {
+			nextCursor := page.Messages[limit-1].Id
+			page.NextCursor = &nextCursor
+			break
+		}
+		message, ok := storage.messages[key.messageId]
+		if !ok {
+			page.Missing = append(page.Missing, int(key.messageId))
+			continue
+		}
+		if (query.Since != nil && message.created.Before(*query.Since)) ||
+			(query.Until != nil && !message.created.Before(*query.Until)) ||
+			message.expired(time.Now()) {
+			continue
+		}
+		page.Messages = append(page.Messages, message.readAll(key.messageId, storage.receivers[key]))
+	}
+	return page, nil
+}
+
+func (storage *MemStorage) set(who string, message_id int, read bool) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	key := memReceiverKey{uint64(message_id), who}
+	if _, ok := storage.receivers[key]; ok {
+		storage.receivers[key] = read
+		storage.notify(who, EVENT_READ, map[string]interface{}{
+			"message_id": message_id,
+			"read":       read,
+		})
+	}
+	return nil
+}
+
+func (storage *MemStorage) countUnread(who string) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	// The expired messages are not counted, as in read
+	now := time.Now()
+	count := 0
+	for _, key := range storage.receiverKeys(who, true) {
+		if message, ok := storage.messages[key.messageId]; ok && !message.expired(now) && count < LIMIT_MSG {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (storage *MemStorage) delete(who string, message_id int) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	delete(storage.receivers, memReceiverKey{uint64(message_id), who})
+	for key := range storage.receivers {
+		if key.messageId == uint64(message_id) {
+			return nil
+		}
+	}
+	delete(storage.messages, uint64(message_id))
+	return nil
+}
+
+func (storage *MemStorage) expireMessages(now time.Time, createdBefore *time.Time, limit int) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	expired := make(map[uint64]bool)
+	for id, message := range storage.messages {
+		if len(expired) == limit {
+			break
+		}
+		if message.expired(now) || (createdBefore != nil && message.created.Before(*createdBefore)) {
+			expired[id] = true
+		}
+	}
+	for key := range storage.receivers {
+		if expired[key.messageId] {
+			delete(storage.receivers, key)
+		}
+	}
+	for id := range expired {
+		delete(storage.messages, id)
+	}
+	return len(expired), nil
+}
+
+func (storage *MemStorage) actorLikes(activity Activity) (uint64, error) {
+	if activity.Type != "Like" {
+		return 0, apiErrorf(CODE_BAD_REQUEST, "Not a Like activity")
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	id := storage.nextLikedId
+	storage.nextLikedId++
+	storage.liked[id] = memLiked{
+		actor:    activity.Actor,
+		object:   activity.Object,
+		summary:  activity.Summary,
+		activity: activity.Id,
+	}
+	return id, nil
+}
+
+func (storage *MemStorage) findActorLike(id uint64) (*Activity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	liked, ok := storage.liked[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: like", ErrNotFound)
+	}
+	return liked.toActivity(), nil
+}
+
+func (liked memLiked) toActivity() *Activity {
+	return &Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		Type:    "Like",
+		Id:      liked.activity,
+		Actor:   liked.actor,
+		Object:  liked.object,
+		Summary: liked.summary,
+	}
+}
+
+func (storage *MemStorage) objectLikes(object string, limit int) (LikesPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var page LikesPage
+	for cod, liked := range storage.liked {
+		if liked.object == object {
+			page.Cods = append(page.Cods, cod)
+		}
+	}
+	page.Total = len(page.Cods)
+	sort.Slice(page.Cods, func(i, j int) bool { return page.Cods[i] < page.Cods[j] })
+	if len(page.Cods) > limit {
+		page.Cods = page.Cods[:limit]
+	}
+	for _, cod := range page.Cods {
+		page.Likes = append(page.Likes, *storage.liked[cod].toActivity())
+	}
+	return page, nil
+}
+
+func (storage *MemStorage) findObjectLike(actor string, object string) (uint64, bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for cod, liked := range storage.liked {
+		if liked.actor == actor && liked.object == object {
+			return cod, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (storage *MemStorage) removeLike(id uint64) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	_, ok := storage.liked[id]
+	delete(storage.liked, id)
+	return ok, nil
+}
+
+func (storage *MemStorage) findActorLikes(id string) ([]uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var ids []uint64
+	for likedId, liked := range storage.liked {
+		if liked.actor == id {
+			ids = append(ids, likedId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > LIMIT_MSG {
+		ids = ids[:LIMIT_MSG]
+	}
+	return ids, nil
+}
+
+func (storage *MemStorage) findActorFollow(id uint64) (*Activity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	follow, ok := storage.follow[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: follow", ErrNotFound)
+	}
+	return &Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		Type:    "Follow",
+		Id:      follow.activity,
+		Actor:   follow.follower,
+		Object:  follow.following,
+	}, nil
+}
+
+// Looks for the follow with the given (following, follower), which is
+// unique as in the index following of tarantool
+func (storage *MemStorage) findFollow(following, follower string) (uint64, bool) {
+	for id, follow := range storage.follow {
+		if follow.following == following && follow.follower == follower {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (storage *MemStorage) storeFollower(activity Activity, accepted bool) (bool, uint64, error) {
+	if activity.Type != "Follow" {
+		return false, 0, apiErrorf(CODE_BAD_REQUEST, "Not a Follow activity")
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if cod, ok := storage.findFollow(activity.Object, activity.Actor); ok {
+		follow := storage.follow[cod]
+		if follow.rejected {
+			follow.accepted = accepted
+			follow.rejected = false
+		} else if !follow.accepted && accepted {
+			follow.accepted = accepted
+		}
+		if activity.Id != "" {
+			follow.activity = activity.Id
+		}
+		storage.follow[cod] = follow
+		return false, cod, nil
+	}
+	cod := storage.nextFollowId
+	storage.nextFollowId++
+	storage.follow[cod] = memFollow{
+		follower:  activity.Actor,
+		following: activity.Object,
+		accepted:  accepted,
+		activity:  activity.Id,
+	}
+	return true, cod, nil
+}
+
+func (storage *MemStorage) updateFollower(id uint64, accepted bool, rejected bool) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	follow, ok := storage.follow[id]
+	if !ok {
+		return fmt.Errorf("%w: follow", ErrNotFound)
+	}
+	follow.accepted = accepted
+	follow.rejected = rejected
+	storage.follow[id] = follow
+	return nil
+}
+
+func (storage *MemStorage) acceptFollower(id uint64) error {
+	return storage.updateFollower(id, true, false)
+}
+
+func (storage *MemStorage) rejectFollower(id uint64) error {
+	return storage.updateFollower(id, false, true)
+}
+
+func (storage *MemStorage) pendingFollowers(actor string) ([]FollowRequest, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var requests []FollowRequest
+	for cod, follow := range storage.follow {
+		if follow.following == actor && !follow.accepted && !follow.rejected {
+			requests = append(requests, FollowRequest{Id: cod, Actor: follow.follower})
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Id < requests[j].Id })
+	if len(requests) > LIMIT_MSG {
+		requests = requests[:LIMIT_MSG]
+	}
+	return requests, nil
+}
+
+func (storage *MemStorage) followPolicy(actor string) (string, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if policy, ok := storage.followPolicies[actor]; ok {
+		return policy, nil
+	}
+	return FOLLOW_POLICY_AUTO, nil
+}
+
+func (storage *MemStorage) setFollowPolicy(actor string, policy string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.followPolicies[actor] = policy
+	return nil
+}
+
+func (storage *MemStorage) findActorFollows(id string, follower bool) ([]string, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var cods []uint64
+	for cod, follow := range storage.follow {
+		if !follow.accepted {
+			continue
+		}
+		if (follower && follow.follower == id) || (!follower && follow.following == id) {
+			cods = append(cods, cod)
+		}
+	}
+	sort.Slice(cods, func(i, j int) bool { return cods[i] < cods[j] })
+	if len(cods) > LIMIT_MSG {
+		cods = cods[:LIMIT_MSG]
+	}
+	var ids []string
+	for _, cod := range cods {
+		if follower {
+			ids = append(ids, storage.follow[cod].following)
+		} else {
+			ids = append(ids, storage.follow[cod].follower)
+		}
+	}
+	return ids, nil
+}
+
+func (storage *MemStorage) countActorFollows(id string, follower bool) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	count := 0
+	for _, follow := range storage.follow {
+		if follow.accepted && ((follower && follow.follower == id) || (!follower && follow.following == id)) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (storage *MemStorage) events(after uint64, limit int) ([]Event, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var events []Event
+	for _, e := range storage.eventLog {
+		if len(events) == limit {
+			break
+		}
+		if e.event.Id > after {
+			events = append(events, e.event)
+		}
+	}
+	return events, nil
+}
+
+func (storage *MemStorage) receiverEvents(receiver string, after uint64, limit int) ([]Event, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var events []Event
+	for _, e := range storage.eventLog {
+		if len(events) == limit {
+			break
+		}
+		if e.event.Id > after && e.event.Receiver == receiver {
+			events = append(events, e.event)
+		}
+	}
+	return events, nil
+}
+
+func (storage *MemStorage) lastEventId() (uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.nextEventId - 1, nil
+}
+
+func (storage *MemStorage) storeNonce(agent, nonce string, expires time.Time) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	now := time.Now()
+	for key, expiration := range storage.nonces {
+		if expiration.Before(now) {
+			delete(storage.nonces, key)
+		}
+	}
+	key := memNonceKey{agent, nonce}
+	if _, ok := storage.nonces[key]; ok {
+		return false, nil
+	}
+	storage.nonces[key] = expires
+	return true, nil
+}
+
+func (storage *MemStorage) actorKey(actor string, generate func() (string, error)) (string, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if key, ok := storage.actorKeys[actor]; ok {
+		return key, nil
+	}
+	key, err := generate()
+	if err != nil {
+		return "", err
+	}
+	storage.actorKeys[actor] = key
+	return key, nil
+}
+
+func (storage *MemStorage) enqueueDelivery(delivery QueuedDelivery) (uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	// Completed deliveries are removed after a while, as in db/inbox.lua
+	for id, completed := range storage.deliveries {
+		if completed.Status == DELIVERY_DELIVERED && time.Since(completed.NextAttempt) > MEM_DELIVERIES_TTL {
+			delete(storage.deliveries, id)
+		}
+	}
+	delivery.Id = storage.nextDeliveryId
+	storage.nextDeliveryId++
+	storage.deliveries[delivery.Id] = delivery
+	return delivery.Id, nil
+}
+
+func (storage *MemStorage) claimDeliveries(now time.Time, limit int, lease time.Duration) ([]QueuedDelivery, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var due []QueuedDelivery
+	for _, delivery := range storage.deliveries {
+		if delivery.Status == DELIVERY_PENDING && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].NextAttempt = now.Add(lease)
+		storage.deliveries[due[i].Id] = due[i]
+	}
+	return due, nil
+}
+
+func (storage *MemStorage) deliverySucceeded(id uint64) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	delivery, ok := storage.deliveries[id]
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+	delivery.Status = DELIVERY_DELIVERED
+	delivery.NextAttempt = time.Now()
+	storage.deliveries[id] = delivery
+	return nil
+}
+
+func (storage *MemStorage) deliveryFailed(id uint64, lastError string, next time.Time, dead bool) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	delivery, ok := storage.deliveries[id]
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+	delivery.Status = DELIVERY_PENDING
+	if dead {
+		delivery.Status = DELIVERY_DEAD
+	}
+	delivery.Attempts++
+	delivery.NextAttempt = next
+	delivery.LastError = lastError
+	storage.deliveries[id] = delivery
+	return nil
+}
+
+func (storage *MemStorage) retryDelivery(id uint64) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	delivery, ok := storage.deliveries[id]
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+	delivery.Status = DELIVERY_PENDING
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now()
+	storage.deliveries[id] = delivery
+	return nil
+}
+
+func (storage *MemStorage) removeDelivery(id uint64) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.deliveries[id]; !ok {
+		return ErrDeliveryNotFound
+	}
+	delete(storage.deliveries, id)
+	return nil
+}
+
+func (storage *MemStorage) listDeliveries(status string, limit int) ([]QueuedDelivery, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var deliveries []QueuedDelivery
+	for _, delivery := range storage.deliveries {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id < deliveries[j].Id
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (storage *MemStorage) removeFollower(follower, following string) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	cod, ok := storage.findFollow(following, follower)
+	if ok {
+		delete(storage.follow, cod)
+	}
+	return ok, nil
+}
+
+func (storage *MemStorage) nextActivityId() (uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.activitySeq++
+	return storage.activitySeq, nil
+}
+
+func (storage *MemStorage) storeActivity(activity StoredActivity) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.activities[activity.Id]; ok {
+		return errors.New("Duplicate activity")
+	}
+	storage.activities[activity.Id] = activity
+	return nil
+}
+
+// Page of the activities of owner, the newest first, the lock has to be held
+func activityPage(activities map[uint64]StoredActivity, owner string, before uint64, limit int) ActivityPage {
+	var page ActivityPage
+	var ids []uint64
+	for id, activity := range activities {
+		if activity.Actor == owner {
+			page.Total++
+			if before == 0 || id < before {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	for _, id := range ids {
+		page.Activities = append(page.Activities, activities[id])
+	}
+	return page
+}
+
+func (storage *MemStorage) outbox(actor string, before uint64, limit int) (ActivityPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return activityPage(storage.activities, actor, before, limit), nil
+}
+
+func (storage *MemStorage) findActivity(id uint64) (*StoredActivity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	activity, ok := storage.activities[id]
+	if !ok {
+		return nil, ErrActivityNotFound
+	}
+	return &activity, nil
+}
+
+func (storage *MemStorage) storeDirect(activity StoredActivity) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.directs[activity.Id]; ok {
+		return errors.New("Duplicate activity")
+	}
+	storage.directs[activity.Id] = activity
+	return nil
+}
+
+func (storage *MemStorage) findDirect(id uint64) (*StoredActivity, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	activity, ok := storage.directs[id]
+	if !ok {
+		return nil, ErrActivityNotFound
+	}
+	return &activity, nil
+}
+
+func (storage *MemStorage) storeReceived(activity StoredActivity) (uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.receivedSeq++
+	activity.Id = storage.receivedSeq
+	storage.inboxes[activity.Id] = activity
+	return activity.Id, nil
+}
+
+func (storage *MemStorage) received(receiver string, before uint64, limit int) (ActivityPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return activityPage(storage.inboxes, receiver, before, limit), nil
+}
+
+func (storage *MemStorage) findReceived(receiver string, activityId string) (uint64, bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for id, activity := range storage.inboxes {
+		if activity.Actor == receiver && activity.ActivityId == activityId {
+			return id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Returns whether who can see the message, as its sender or one of its
+// receivers, and whether it has read it. The lock must be held.
+func (storage *MemStorage) visible(id uint64, message memMessage, who string) (bool, bool) {
+	if message.expired(time.Now()) {
+		return false, false
+	}
+	if message.sender == who {
+		return true, true
+	}
+	read, ok := storage.receivers[memReceiverKey{id, who}]
+	return ok, read
+}
+
+func (storage *MemStorage) messageThread(agent string, id int) (int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	message, ok := storage.messages[uint64(id)]
+	if ok {
+		ok, _ = storage.visible(uint64(id), message, agent)
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: message %d", ErrNotFound, id)
+	}
+	return int(message.threadId), nil
+}
+
+func (storage *MemStorage) threads(query ThreadsQuery) (ThreadsPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	page := ThreadsPage{Threads: []Thread{}}
+	latest := make(map[uint64]uint64)
+	unread := make(map[uint64]int)
+	now := time.Now()
+	for id, message := range storage.messages {
+		// As in tarantool, the expired messages are counted until they
+		// are removed
+		if message.expired(now) {
+			if read, ok := storage.receivers[memReceiverKey{id, query.Agent}]; ok && !read {
+				unread[message.threadId]++
+			}
+			continue
+		}
+		visible, read := storage.visible(id, message, query.Agent)
+		if !visible {
+			continue
+		}
+		if last, ok := latest[message.threadId]; !ok || last < id {
+			latest[message.threadId] = id
+		}
+		if !read {
+			unread[message.threadId]++
+		}
+	}
+	var threads []uint64
+	for thread, last := range latest {
+		if query.Cursor == nil || last < uint64(*query.Cursor) {
+			threads = append(threads, thread)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return latest[threads[i]] > latest[threads[j]]
+	})
+
+	limit := pageSize(query.Limit)
+	for _, thread := range threads {
+		if len(page.Threads) == limit {
+			nextCursor := page.Threads[limit-1].Latest.Id
+			page.NextCursor = &nextCursor
+			break
+		}
+		id := latest[thread]
+		_, read := storage.visible(id, storage.messages[id], query.Agent)
+		page.Threads = append(page.Threads, Thread{
+			Id:     int(thread),
+			Latest: storage.messages[id].readAll(id, read),
+			Unread: unread[thread],
+		})
+	}
+	return page, nil
+}
+
+func (storage *MemStorage) thread(query ThreadQuery) (ReadPage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	page := ReadPage{Messages: []ReadAll{}}
+	var ids []uint64
+	for id, message := range storage.messages {
+		if message.threadId != uint64(query.ThreadId) {
+			continue
+		}
+		if query.Cursor != nil && id <= uint64(*query.Cursor) {
+			continue
+		}
+		if visible, _ := storage.visible(id, message, query.Agent); visible {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	limit := pageSize(query.Limit)
+	for _, id := range ids {
+		if len(page.Messages) == limit {
+			nextCursor := page.Messages[limit-1].Id
+			page.NextCursor = &nextCursor
+			break
+		}
+		_, read := storage.visible(id, storage.messages[id], query.Agent)
+		page.Messages = append(page.Messages, storage.messages[id].readAll(id, read))
+	}
+	return page, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/tarantool/go-tarantool"
 	"log"
 	"time"
@@ -13,14 +14,70 @@ type TTStorage struct {
 }
 
 type ReadAll struct {
-	Id      int                    `json:"id"`
-	Sender  string                 `json:"sender"`
-	Content map[string]interface{} `json:"content"`
-	Read    bool                   `json:"read"`
+	Id        int                    `json:"id"`
+	Sender    string                 `json:"sender"`
+	Content   map[string]interface{} `json:"content"`
+	Read      bool                   `json:"read"`
+	ThreadId  int                    `json:"thread_id"`
+	InReplyTo *int                   `json:"in_reply_to"`
+	// When the message has been stored
+	Created time.Time `json:"created"`
+	// Nil if the message does not expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Message returned by the stored procedures (see message_of in db/inbox.lua)
+func readAllFromMap(m map[interface{}]interface{}) (ReadAll, error) {
+	message := ReadAll{
+		Id:       int(m["id"].(uint64)),
+		Sender:   m["sender"].(string),
+		Read:     m["read"].(bool),
+		ThreadId: int(m["thread_id"].(uint64)),
+		Created:  toTime(m["created"]),
+	}
+	if inReplyTo, ok := m["in_reply_to"].(uint64); ok {
+		id := int(inReplyTo)
+		message.InReplyTo = &id
+	}
+	if m["expires_at"] != nil {
+		expiresAt := toTime(m["expires_at"])
+		message.ExpiresAt = &expiresAt
+	}
+	err := json.Unmarshal([]byte(m["content"].(string)), &message.Content)
+	return message, err
+}
+
+// Optional id, as it is passed to the stored procedures
+func optionalId(id *int) interface{} {
+	if id == nil {
+		return nil
+	}
+	return uint64(*id)
+}
+
+// Optional time, as it is passed to the stored procedures
+func optionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return fromTime(*t)
 }
 
 const MAX_RETRY int = 10
 
+// Calls the stored procedure, again if its transaction has been aborted by
+// a conflict with a concurrent one, up to MAX_RETRY times
+func (storage *TTStorage) callRetry(function string, args []interface{}) (*tarantool.Response, error) {
+	for retry := 0; ; retry++ {
+		resp, err := storage.db.Call17(function, args)
+		var ttErr tarantool.Error
+		if retry == MAX_RETRY || !errors.As(err, &ttErr) || ttErr.Code != tarantool.ErrTransactionConflict {
+			return resp, err
+		}
+		log.Printf("Conflict in %s, retrying...\n", function)
+	}
+}
+
 func (storage *TTStorage) Init(host, user, pass string) error {
 	var err error
 	for done, retry := false, 0; !done; retry++ {
@@ -39,93 +96,215 @@ func (storage *TTStorage) Init(host, user, pass string) error {
 	return err
 }
 
-func (storage *TTStorage) send(message Message) (int, error) {
-	jsonData, err := json.Marshal(message.Content)
-	resp, err := storage.db.Insert("messages", []interface{}{nil, string(jsonData), message.Sender})
-	if err != nil {
-		return 0, err
-	}
-	message_id := resp.Data[0].([]interface{})[0]
+// Outcome of the delivery of a message to one of its receivers
+type Delivery struct {
+	Receiver string `json:"receiver"`
+	Status   string `json:"status"`
+}
+
+const (
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_DUPLICATE = "duplicate"
+	DELIVERY_REJECTED  = "rejected"
+	// The receiver would have been delivered, but the atomic send failed
+	DELIVERY_ABORTED = "aborted"
+	// The receiver is on another server, the message is in the delivery queue
+	DELIVERY_QUEUED = "queued"
+)
+
+type SendResult struct {
+	MessageId int
+	Receivers []Delivery
+}
+
+// Count the receivers the message has been delivered (or queued) to
+func (result *SendResult) delivered() int {
 	count := 0
-	for i := 0; i < len(message.Receivers); i++ {
-		_, err := storage.db.Insert("receivers", []interface{}{message_id, message.Receivers[i], false})
-		if err == nil {
+	for _, delivery := range result.Receivers {
+		if delivery.Status == DELIVERY_DELIVERED || delivery.Status == DELIVERY_QUEUED {
 			count = count + 1
 		}
 	}
-	return count, nil
+	return count
 }
 
-func (storage *TTStorage) read(who string, onlyUnread bool) ([]ReadAll, error) {
-	var filter []interface{}
-	if onlyUnread {
-		filter = []interface{}{who, false}
-	} else {
-		filter = []interface{}{who}
+var ErrSendAborted = errors.New("Message not delivered, some receivers were rejected")
+
+// The message is delivered in a single transaction by inbox_send (see
+// db/inbox.lua), called again if it conflicts with another send. If message.Atomic is set and a receiver is rejected nothing
+// is stored and ErrSendAborted is returned along with the outcomes.
+func (storage *TTStorage) send(message Message) (SendResult, error) {
+	var result SendResult
+	jsonData, err := json.Marshal(message.Content)
+	if err != nil {
+		return result, err
 	}
-	resp, err := storage.db.Select("receivers", "receivers_idx", 0, 4096, tarantool.IterEq, filter)
-	messages := make([]ReadAll, 0, 5)
+	resp, err := storage.callRetry("inbox_send", []interface{}{
+		string(jsonData), message.Sender, message.Receivers, message.Atomic,
+		optionalId(message.ThreadId), optionalId(message.InReplyTo), optionalTime(message.ExpiresAt),
+	})
 	if err != nil {
-		return messages, err
+		return result, err
+	} else if resp.Error != "" {
+		return result, errors.New(resp.Error)
+	} else if len(resp.Data) < 2 {
+		return result, errors.New("Unexpected response from inbox_send")
 	}
-	for _, d := range resp.Data {
-		id := d.([]interface{})[0]
-		resp2, err := storage.db.Select("messages", "primary", 0, 4096, tarantool.IterEq, []interface{}{id})
-		dataRead := resp2.Data[0].([]interface{})
-
-		// read flag could be null
-		var read bool
-		if len(d.([]interface{})) >= 3 {
-			read = d.([]interface{})[2].(bool)
-		} else {
-			read = false
-		}
-		current := ReadAll{
-			Id:     int(dataRead[0].(uint64)),
-			Sender: dataRead[2].(string),
-			Read:   read,
-		}
-		err = json.Unmarshal([]byte(dataRead[1].(string)), &current.Content)
+
+	outcomes, _ := resp.Data[1].([]interface{})
+	for _, d := range outcomes {
+		outcome := d.(map[interface{}]interface{})
+		receiver, _ := outcome["receiver"].(string)
+		result.Receivers = append(result.Receivers, Delivery{
+			Receiver: receiver,
+			Status:   outcome["status"].(string),
+		})
+	}
+	if resp.Data[0] == nil {
+		return result, ErrSendAborted
+	}
+	result.MessageId = int(resp.Data[0].(uint64))
+	return result, nil
+}
+
+// Parameters of a paginated read of the inbox of Receiver, the messages are
+// sorted by id and Cursor (when present) is the id of the last message of
+// the previous page
+type ReadQuery struct {
+	Receiver   string
+	OnlyUnread bool
+	Cursor     *int
+	Limit      int
+	Desc       bool
+	// Only the messages created in [Since, Until), if they are set
+	Since *time.Time
+	Until *time.Time
+}
+
+type ReadPage struct {
+	Messages []ReadAll
+	// Id of the last message in the page, nil if there are no more messages
+	NextCursor *int
+	// Ids of the messages that have a receiver but do not exist
+	Missing []int
+}
+
+const DEFAULT_READ_LIMIT = 100
+
+// Normalizes the limit of a query, it is always in [1, LIMIT_MSG]
+func pageSize(limit int) int {
+	if limit <= 0 {
+		return DEFAULT_READ_LIMIT
+	}
+	if limit > LIMIT_MSG {
+		return LIMIT_MSG
+	}
+	return limit
+}
+
+func (query *ReadQuery) pageSize() int {
+	return pageSize(query.Limit)
+}
+
+func (storage *TTStorage) read(query ReadQuery) (ReadPage, error) {
+	page := ReadPage{Messages: make([]ReadAll, 0, 5)}
+
+	// The join between receivers and messages is done by inbox_read
+	// (see db/inbox.lua)
+	resp, err := storage.db.Call17("inbox_read", []interface{}{
+		query.Receiver, query.OnlyUnread, optionalId(query.Cursor), query.pageSize(), query.Desc,
+		optionalTime(query.Since), optionalTime(query.Until),
+	})
+	if err != nil {
+		return page, err
+	} else if resp.Error != "" {
+		return page, errors.New(resp.Error)
+	} else if len(resp.Data) < 3 {
+		return page, errors.New("Unexpected response from inbox_read")
+	}
+
+	messages, _ := resp.Data[0].([]interface{})
+	for _, d := range messages {
+		current, err := readAllFromMap(d.(map[interface{}]interface{}))
 		if err != nil {
-			return messages, err
+			return page, err
 		}
-		messages = append(messages, current)
+		page.Messages = append(page.Messages, current)
+	}
+	if resp.Data[1] != nil {
+		nextCursor := int(resp.Data[1].(uint64))
+		page.NextCursor = &nextCursor
+	}
+	missing, _ := resp.Data[2].([]interface{})
+	for _, id := range missing {
+		page.Missing = append(page.Missing, int(id.(uint64)))
 	}
-	return messages, nil
+	return page, nil
 }
 
+// The flag is set by inbox_set_read (see db/inbox.lua), which also records
+// the event for the subscribers
 func (storage *TTStorage) set(who string, message_id int, read bool) error {
-	_, err := storage.db.Update("receivers", "primary", []interface{}{uint64(message_id), who}, []interface{}{[]interface{}{"=", 2, read}})
+	resp, err := storage.callRetry("inbox_set_read", []interface{}{who, uint64(message_id), read})
 	if err != nil {
 		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
 	}
 	return nil
 }
 
 const LIMIT_MSG = 1000
 
+// The expired messages are skipped by inbox_count_unread (see db/inbox.lua)
 func (storage *TTStorage) countUnread(who string) (int, error) {
-	resp, err := storage.db.Select("receivers", "receivers_idx", 0, LIMIT_MSG, tarantool.IterEq, []interface{}{who, false})
+	resp, err := storage.db.Call17("inbox_count_unread", []interface{}{who, LIMIT_MSG})
 	if err != nil {
 		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return 0, errors.New("Unexpected response from inbox_count_unread")
 	}
-
-	return len(resp.Data), nil
+	return int(toFloat(resp.Data[0])), nil
 }
 
+// The message is deleted by inbox_delete (see db/inbox.lua) once it has no
+// receivers
 func (storage *TTStorage) delete(who string, message_id int) error {
-	_, err := storage.db.Delete("receivers", "primary", []interface{}{uint64(message_id), who})
+	resp, err := storage.callRetry("inbox_delete", []interface{}{who, uint64(message_id)})
 	if err != nil {
 		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
 	}
 	return nil
 }
 
+// Deletes up to limit messages that have expired before now or that were
+// created before createdBefore (if not nil), with their receivers
+func (storage *TTStorage) expireMessages(now time.Time, createdBefore *time.Time, limit int) (int, error) {
+	resp, err := storage.callRetry("inbox_expire", []interface{}{fromTime(now), optionalTime(createdBefore), limit})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return 0, errors.New("Unexpected response from inbox_expire")
+	}
+	return int(toFloat(resp.Data[0])), nil
+}
+
 func (storage *TTStorage) actorLikes(activity Activity) (uint64, error) {
 	if activity.Type != "Like" {
-		return 0, errors.New("Not a Like activity")
+		return 0, apiErrorf(CODE_BAD_REQUEST, "Not a Like activity")
 	}
-	resp, err := storage.db.Insert("liked", []interface{}{nil, activity.Actor, activity.Object, activity.Summary})
+	// Only the likes received from other servers have an id
+	var activityId interface{}
+	if activity.Id != "" {
+		activityId = activity.Id
+	}
+	resp, err := storage.db.Insert("liked", []interface{}{nil, activity.Actor, activity.Object, activity.Summary, activityId})
 	if err != nil {
 		return 0, err
 	} else if resp.Error != "" {
@@ -143,7 +322,13 @@ func (storage *TTStorage) findActorLike(id uint64) (*Activity, error) {
 	} else if resp.Error != "" {
 		return nil, errors.New(resp.Error)
 	}
-	data := resp.Data[0].([]interface{})
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("%w: like", ErrNotFound)
+	}
+	return likeFromTuple(resp.Data[0].([]interface{})), nil
+}
+
+func likeFromTuple(data []interface{}) *Activity {
 	act := &Activity{
 		Context: "https://www.w3.org/ns/activitystreams",
 		Type:    "Like",
@@ -151,7 +336,57 @@ func (storage *TTStorage) findActorLike(id uint64) (*Activity, error) {
 		Object:  data[2].(string),
 		Summary: data[3].(string),
 	}
-	return act, nil
+	if len(data) > 4 {
+		act.Id, _ = data[4].(string)
+	}
+	return act
+}
+
+// The likes are read by inbox_object_likes (see db/inbox.lua)
+func (storage *TTStorage) objectLikes(object string, limit int) (LikesPage, error) {
+	var page LikesPage
+	resp, err := storage.db.Call17("inbox_object_likes", []interface{}{object, limit})
+	if err != nil {
+		return page, err
+	} else if resp.Error != "" {
+		return page, errors.New(resp.Error)
+	} else if len(resp.Data) < 2 {
+		return page, errors.New("Unexpected response from inbox_object_likes")
+	}
+	likes, _ := resp.Data[0].([]interface{})
+	for _, l := range likes {
+		tuple := l.([]interface{})
+		page.Likes = append(page.Likes, *likeFromTuple(tuple))
+		page.Cods = append(page.Cods, tuple[0].(uint64))
+	}
+	page.Total = int(toFloat(resp.Data[1]))
+	return page, nil
+}
+
+// Finds the like of object by actor, the second result is false if there
+// is none
+func (storage *TTStorage) findObjectLike(actor string, object string) (uint64, bool, error) {
+	resp, err := storage.db.Select("liked", "object_actor", 0, 1, tarantool.IterEq, []interface{}{object, actor})
+	if err != nil {
+		return 0, false, err
+	} else if resp.Error != "" {
+		return 0, false, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return 0, false, nil
+	}
+	return resp.Data[0].([]interface{})[0].(uint64), true, nil
+}
+
+// Removes the like with the given id, returns false if there was none
+func (storage *TTStorage) removeLike(id uint64) (bool, error) {
+	resp, err := storage.db.Delete("liked", "primary", []interface{}{id})
+	if err != nil {
+		return false, err
+	} else if resp.Error != "" {
+		return false, errors.New(resp.Error)
+	}
+	return len(resp.Data) > 0, nil
 }
 
 func (storage *TTStorage) findActorLikes(id string) ([]uint64, error) {
@@ -167,10 +402,16 @@ func (storage *TTStorage) findActorLikes(id string) ([]uint64, error) {
 	return ids, nil
 }
 
+// A follow request waiting for the approval of the followed actor
+type FollowRequest struct {
+	Id    uint64 `json:"id"`
+	Actor string `json:"actor"`
+}
+
 func (storage *TTStorage) storeFollower(activity Activity, accepted bool) (bool, uint64, error) {
 	created := false
 	if activity.Type != "Follow" {
-		return false, 0, errors.New("Not a Follow activity")
+		return false, 0, apiErrorf(CODE_BAD_REQUEST, "Not a Follow activity")
 	}
 	respRead, err := storage.db.Select("follow", "following", 0, LIMIT_MSG, tarantool.IterEq, []interface{}{activity.Object, activity.Actor})
 	if err != nil {
@@ -182,7 +423,7 @@ func (storage *TTStorage) storeFollower(activity Activity, accepted bool) (bool,
 	var cod uint64
 	if len(data) == 0 {
 		resp, err := storage.db.Insert("follow",
-			[]interface{}{nil, activity.Actor, activity.Object, accepted})
+			[]interface{}{nil, activity.Actor, activity.Object, accepted, false, activity.Id})
 		if err != nil {
 			return false, 0, err
 		} else if resp.Error != "" {
@@ -192,12 +433,21 @@ func (storage *TTStorage) storeFollower(activity Activity, accepted bool) (bool,
 		cod = dataWritten[0].(uint64)
 		created = true
 	} else {
-		cod = data[0].([]interface{})[0].(uint64)
-		currentAccepted := data[0].([]interface{})[3].(bool)
-		if !currentAccepted && accepted {
-			resp, err := storage.db.Update("follow", "primary",
-				[]interface{}{cod},
-				[]interface{}{[]interface{}{"=", 4, accepted}})
+		tuple := data[0].([]interface{})
+		cod = tuple[0].(uint64)
+		currentAccepted := tuple[3].(bool)
+		var ops []interface{}
+		// A new request after a rejection is pending again
+		if len(tuple) > 4 && tuple[4] == true {
+			ops = append(ops, []interface{}{"=", 3, accepted}, []interface{}{"=", 4, false})
+		} else if !currentAccepted && accepted {
+			ops = append(ops, []interface{}{"=", 3, accepted})
+		}
+		if activity.Id != "" {
+			ops = append(ops, []interface{}{"=", 5, activity.Id})
+		}
+		if len(ops) > 0 {
+			resp, err := storage.db.Update("follow", "primary", []interface{}{cod}, ops)
 			if err != nil {
 				return false, 0, err
 			} else if resp.Error != "" {
@@ -209,10 +459,68 @@ func (storage *TTStorage) storeFollower(activity Activity, accepted bool) (bool,
 	return created, cod, nil
 }
 
-func (storage *TTStorage) acceptFollower(id uint64) error {
+func (storage *TTStorage) updateFollower(id uint64, accepted bool, rejected bool) error {
 	resp, err := storage.db.Update("follow", "primary",
 		[]interface{}{id},
-		[]interface{}{[]interface{}{"=", 4, true}})
+		[]interface{}{
+			[]interface{}{"=", 3, accepted},
+			[]interface{}{"=", 4, rejected},
+		})
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return fmt.Errorf("%w: follow", ErrNotFound)
+	}
+	return nil
+}
+
+func (storage *TTStorage) acceptFollower(id uint64) error {
+	return storage.updateFollower(id, true, false)
+}
+
+func (storage *TTStorage) rejectFollower(id uint64) error {
+	return storage.updateFollower(id, false, true)
+}
+
+// The requests received by actor that are neither accepted nor rejected
+func (storage *TTStorage) pendingFollowers(actor string) ([]FollowRequest, error) {
+	resp, err := storage.db.Select("follow", "following", 0, LIMIT_MSG, tarantool.IterEq, []interface{}{actor})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	var requests []FollowRequest
+	for _, d := range resp.Data {
+		tuple := d.([]interface{})
+		if tuple[3].(bool) || (len(tuple) > 4 && tuple[4] == true) {
+			continue
+		}
+		requests = append(requests, FollowRequest{
+			Id:    tuple[0].(uint64),
+			Actor: tuple[1].(string),
+		})
+	}
+	return requests, nil
+}
+
+func (storage *TTStorage) followPolicy(actor string) (string, error) {
+	resp, err := storage.db.Select("follow_policies", "primary", 0, 1, tarantool.IterEq, []interface{}{actor})
+	if err != nil {
+		return "", err
+	} else if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return FOLLOW_POLICY_AUTO, nil
+	}
+	return resp.Data[0].([]interface{})[1].(string), nil
+}
+
+func (storage *TTStorage) setFollowPolicy(actor string, policy string) error {
+	resp, err := storage.db.Replace("follow_policies", []interface{}{actor, policy})
 	if err != nil {
 		return err
 	} else if resp.Error != "" {
@@ -221,6 +529,29 @@ func (storage *TTStorage) acceptFollower(id uint64) error {
 	return nil
 }
 
+func (storage *TTStorage) findActorFollow(id uint64) (*Activity, error) {
+	resp, err := storage.db.Select("follow", "primary", 0, 1, tarantool.IterEq, []interface{}{id})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("%w: follow", ErrNotFound)
+	}
+	data := resp.Data[0].([]interface{})
+	act := &Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		Type:    "Follow",
+		Actor:   data[1].(string),
+		Object:  data[2].(string),
+	}
+	if len(data) > 5 {
+		act.Id, _ = data[5].(string)
+	}
+	return act, nil
+}
+
 func (storage *TTStorage) findActorFollows(id string, follower bool) ([]string, error) {
 	idx := "following"
 	pos := 1
@@ -236,8 +567,504 @@ func (storage *TTStorage) findActorFollows(id string, follower bool) ([]string,
 	}
 	var ids []string
 	for _, d := range resp.Data {
-		id := d.([]interface{})[pos].(string)
-		ids = append(ids, id)
+		tuple := d.([]interface{})
+		// Only the accepted follows are in the collections
+		if !tuple[3].(bool) {
+			continue
+		}
+		ids = append(ids, tuple[pos].(string))
 	}
 	return ids, nil
 }
+
+// The follows are counted by inbox_count_follows (see db/inbox.lua)
+func (storage *TTStorage) countActorFollows(id string, follower bool) (int, error) {
+	resp, err := storage.db.Call17("inbox_count_follows", []interface{}{id, follower})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return 0, errors.New("Unexpected response from inbox_count_follows")
+	}
+	return int(toFloat(resp.Data[0])), nil
+}
+
+func eventsFromTuples(data []interface{}) ([]Event, error) {
+	var events []Event
+	for _, d := range data {
+		tuple := d.([]interface{})
+		event := Event{
+			Id:       tuple[0].(uint64),
+			Receiver: tuple[1].(string),
+			Type:     tuple[2].(string),
+		}
+		if err := json.Unmarshal([]byte(tuple[3].(string)), &event.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (storage *TTStorage) events(after uint64, limit int) ([]Event, error) {
+	resp, err := storage.db.Select("events", "primary", 0, uint32(limit), tarantool.IterGt, []interface{}{after})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return eventsFromTuples(resp.Data)
+}
+
+func (storage *TTStorage) receiverEvents(receiver string, after uint64, limit int) ([]Event, error) {
+	resp, err := storage.db.Select("events", "receiver", 0, uint32(limit), tarantool.IterGt, []interface{}{receiver, after})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	var data []interface{}
+	// The iterator goes on with the events of the next receivers
+	for _, d := range resp.Data {
+		if d.([]interface{})[1].(string) != receiver {
+			break
+		}
+		data = append(data, d)
+	}
+	return eventsFromTuples(data)
+}
+
+// Returns the id of the last event stored, 0 if there are none
+func (storage *TTStorage) lastEventId() (uint64, error) {
+	resp, err := storage.db.Select("events", "primary", 0, 1, tarantool.IterLe, []interface{}{})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return 0, nil
+	}
+	return resp.Data[0].([]interface{})[0].(uint64), nil
+}
+
+// Stores the nonce used by agent in a signed request, returns false if it
+// was already there
+func (storage *TTStorage) storeNonce(agent, nonce string, expires time.Time) (bool, error) {
+	resp, err := storage.db.Insert("nonces", []interface{}{agent, nonce, float64(expires.Unix())})
+	if tntErr, ok := err.(tarantool.Error); ok && tntErr.Code == tarantool.ErrTupleFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if resp.Error != "" {
+		return false, errors.New(resp.Error)
+	}
+	return true, nil
+}
+
+// Returns the private key (PEM) of a local actor, if it does not exist it is
+// created with generate
+func (storage *TTStorage) actorKey(actor string, generate func() (string, error)) (string, error) {
+	resp, err := storage.db.Select("actor_keys", "primary", 0, 1, tarantool.IterEq, []interface{}{actor})
+	if err != nil {
+		return "", err
+	} else if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	if len(resp.Data) > 0 {
+		return resp.Data[0].([]interface{})[1].(string), nil
+	}
+
+	key, err := generate()
+	if err != nil {
+		return "", err
+	}
+	_, err = storage.db.Insert("actor_keys", []interface{}{actor, key})
+	if tntErr, ok := err.(tarantool.Error); ok && tntErr.Code == tarantool.ErrTupleFound {
+		// Another instance created it in the meantime
+		return storage.actorKey(actor, generate)
+	} else if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Numbers can be decoded as integers or floats
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case uint64:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func toTime(v interface{}) time.Time {
+	return time.UnixMilli(int64(toFloat(v) * 1000))
+}
+
+func fromTime(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+func deliveryFromTuple(tuple []interface{}) QueuedDelivery {
+	return QueuedDelivery{
+		Id:          tuple[0].(uint64),
+		Actor:       tuple[1].(string),
+		Target:      tuple[2].(string),
+		Host:        tuple[3].(string),
+		Activity:    tuple[4].(string),
+		Status:      tuple[5].(string),
+		Attempts:    int(toFloat(tuple[6])),
+		NextAttempt: toTime(tuple[7]),
+		LastError:   tuple[8].(string),
+		Created:     toTime(tuple[9]),
+	}
+}
+
+func (storage *TTStorage) enqueueDelivery(delivery QueuedDelivery) (uint64, error) {
+	resp, err := storage.db.Insert("deliveries", []interface{}{
+		nil, delivery.Actor, delivery.Target, delivery.Host, delivery.Activity,
+		delivery.Status, uint64(delivery.Attempts), fromTime(delivery.NextAttempt),
+		delivery.LastError, fromTime(delivery.Created),
+	})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	return resp.Data[0].([]interface{})[0].(uint64), nil
+}
+
+// The deliveries are claimed by inbox_claim_deliveries (see db/inbox.lua)
+func (storage *TTStorage) claimDeliveries(now time.Time, limit int, lease time.Duration) ([]QueuedDelivery, error) {
+	resp, err := storage.db.Call17("inbox_claim_deliveries", []interface{}{fromTime(now), limit, lease.Seconds()})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return nil, errors.New("Unexpected response from inbox_claim_deliveries")
+	}
+	var deliveries []QueuedDelivery
+	claimed, _ := resp.Data[0].([]interface{})
+	for _, d := range claimed {
+		deliveries = append(deliveries, deliveryFromTuple(d.([]interface{})))
+	}
+	return deliveries, nil
+}
+
+func (storage *TTStorage) updateDelivery(id uint64, ops []interface{}) error {
+	resp, err := storage.db.Update("deliveries", "primary", []interface{}{id}, ops)
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+func (storage *TTStorage) deliverySucceeded(id uint64) error {
+	return storage.updateDelivery(id, []interface{}{
+		[]interface{}{"=", 5, DELIVERY_DELIVERED},
+		[]interface{}{"=", 7, fromTime(time.Now())},
+	})
+}
+
+func (storage *TTStorage) deliveryFailed(id uint64, lastError string, next time.Time, dead bool) error {
+	status := DELIVERY_PENDING
+	if dead {
+		status = DELIVERY_DEAD
+	}
+	return storage.updateDelivery(id, []interface{}{
+		[]interface{}{"=", 5, status},
+		[]interface{}{"+", 6, uint64(1)},
+		[]interface{}{"=", 7, fromTime(next)},
+		[]interface{}{"=", 8, lastError},
+	})
+}
+
+// Puts back a delivery in the queue, with no attempts
+func (storage *TTStorage) retryDelivery(id uint64) error {
+	return storage.updateDelivery(id, []interface{}{
+		[]interface{}{"=", 5, DELIVERY_PENDING},
+		[]interface{}{"=", 6, uint64(0)},
+		[]interface{}{"=", 7, fromTime(time.Now())},
+	})
+}
+
+// Deletes a delivery, the space is vinyl so nothing tells if it existed
+func (storage *TTStorage) removeDelivery(id uint64) error {
+	resp, err := storage.db.Delete("deliveries", "primary", []interface{}{id})
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// Lists the deliveries with the given status (all of them if it is empty)
+func (storage *TTStorage) listDeliveries(status string, limit int) ([]QueuedDelivery, error) {
+	var resp *tarantool.Response
+	var err error
+	if status == "" {
+		resp, err = storage.db.Select("deliveries", "primary", 0, uint32(limit), tarantool.IterAll, []interface{}{})
+	} else {
+		resp, err = storage.db.Select("deliveries", "due", 0, uint32(limit), tarantool.IterEq, []interface{}{status})
+	}
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	var deliveries []QueuedDelivery
+	for _, d := range resp.Data {
+		deliveries = append(deliveries, deliveryFromTuple(d.([]interface{})))
+	}
+	return deliveries, nil
+}
+
+// Removes the follow of following by follower, returns false if there was
+// none
+func (storage *TTStorage) removeFollower(follower, following string) (bool, error) {
+	respRead, err := storage.db.Select("follow", "following", 0, 1, tarantool.IterEq, []interface{}{following, follower})
+	if err != nil {
+		return false, err
+	} else if respRead.Error != "" {
+		return false, errors.New(respRead.Error)
+	}
+	if len(respRead.Data) == 0 {
+		return false, nil
+	}
+	cod := respRead.Data[0].([]interface{})[0].(uint64)
+	resp, err := storage.db.Delete("follow", "primary", []interface{}{cod})
+	if err != nil {
+		return false, err
+	} else if resp.Error != "" {
+		return false, errors.New(resp.Error)
+	}
+	return true, nil
+}
+
+// The id is reserved by inbox_next_activity_id (see db/inbox.lua)
+func (storage *TTStorage) nextActivityId() (uint64, error) {
+	resp, err := storage.db.Call17("inbox_next_activity_id", []interface{}{})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	} else if len(resp.Data) == 0 {
+		return 0, errors.New("Unexpected response from inbox_next_activity_id")
+	}
+	return uint64(toFloat(resp.Data[0])), nil
+}
+
+func (storage *TTStorage) storeActivity(activity StoredActivity) error {
+	resp, err := storage.db.Insert("activities", []interface{}{
+		activity.Id, activity.Actor, activity.Type, activity.Activity, fromTime(activity.Created),
+	})
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func activityFromTuple(tuple []interface{}) StoredActivity {
+	return StoredActivity{
+		Id:       uint64(toFloat(tuple[0])),
+		Actor:    tuple[1].(string),
+		Type:     tuple[2].(string),
+		Activity: tuple[3].(string),
+		Created:  toTime(tuple[4]),
+	}
+}
+
+// Reads the page returned by one of the Lua functions of the activities
+func (storage *TTStorage) activityPage(function string, owner string, before uint64, limit int) (ActivityPage, error) {
+	var page ActivityPage
+	var cursor interface{}
+	if before > 0 {
+		cursor = before
+	}
+	resp, err := storage.db.Call17(function, []interface{}{owner, cursor, limit})
+	if err != nil {
+		return page, err
+	} else if resp.Error != "" {
+		return page, errors.New(resp.Error)
+	} else if len(resp.Data) < 2 {
+		return page, errors.New("Unexpected response from " + function)
+	}
+	activities, _ := resp.Data[0].([]interface{})
+	for _, a := range activities {
+		page.Activities = append(page.Activities, activityFromTuple(a.([]interface{})))
+	}
+	page.Total = int(toFloat(resp.Data[1]))
+	return page, nil
+}
+
+// The page is read by inbox_outbox (see db/inbox.lua)
+func (storage *TTStorage) outbox(actor string, before uint64, limit int) (ActivityPage, error) {
+	return storage.activityPage("inbox_outbox", actor, before, limit)
+}
+
+func (storage *TTStorage) findActivity(id uint64) (*StoredActivity, error) {
+	resp, err := storage.db.Select("activities", "primary", 0, 1, tarantool.IterEq, []interface{}{id})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return nil, ErrActivityNotFound
+	}
+	activity := activityFromTuple(resp.Data[0].([]interface{}))
+	return &activity, nil
+}
+
+// Stores a direct activity, not in the outbox of its actor
+func (storage *TTStorage) storeDirect(activity StoredActivity) error {
+	resp, err := storage.db.Insert("direct_activities", []interface{}{
+		activity.Id, activity.Actor, activity.Type, activity.Activity, fromTime(activity.Created), activity.Audience,
+	})
+	if err != nil {
+		return err
+	} else if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (storage *TTStorage) findDirect(id uint64) (*StoredActivity, error) {
+	resp, err := storage.db.Select("direct_activities", "primary", 0, 1, tarantool.IterEq, []interface{}{id})
+	if err != nil {
+		return nil, err
+	} else if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return nil, ErrActivityNotFound
+	}
+	tuple := resp.Data[0].([]interface{})
+	activity := activityFromTuple(tuple)
+	audience, _ := tuple[5].([]interface{})
+	for _, actor := range audience {
+		activity.Audience = append(activity.Audience, actor.(string))
+	}
+	return &activity, nil
+}
+
+// Stores an activity received by the local actor activity.Actor
+func (storage *TTStorage) storeReceived(activity StoredActivity) (uint64, error) {
+	var activityId interface{}
+	if activity.ActivityId != "" {
+		activityId = activity.ActivityId
+	}
+	resp, err := storage.db.Insert("received", []interface{}{
+		nil, activity.Actor, activity.Type, activity.Activity, fromTime(activity.Created), activityId,
+	})
+	if err != nil {
+		return 0, err
+	} else if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	return resp.Data[0].([]interface{})[0].(uint64), nil
+}
+
+// The page is read by inbox_received (see db/inbox.lua)
+func (storage *TTStorage) received(receiver string, before uint64, limit int) (ActivityPage, error) {
+	return storage.activityPage("inbox_received", receiver, before, limit)
+}
+
+// Finds the activity with the given id received by receiver
+func (storage *TTStorage) findReceived(receiver string, activityId string) (uint64, bool, error) {
+	resp, err := storage.db.Select("received", "activity_id", 0, 1, tarantool.IterEq, []interface{}{receiver, activityId})
+	if err != nil {
+		return 0, false, err
+	} else if resp.Error != "" {
+		return 0, false, errors.New(resp.Error)
+	}
+	if len(resp.Data) == 0 {
+		return 0, false, nil
+	}
+	return resp.Data[0].([]interface{})[0].(uint64), true, nil
+}
+
+func (storage *TTStorage) messageThread(agent string, id int) (int, error) {
+	resp, err := storage.db.Call17("inbox_message_thread", []interface{}{uint64(id), agent})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Data) == 0 || resp.Data[0] == nil {
+		return 0, fmt.Errorf("%w: message %d", ErrNotFound, id)
+	}
+	return int(resp.Data[0].(uint64)), nil
+}
+
+// The threads are grouped by inbox_threads (see db/inbox.lua)
+func (storage *TTStorage) threads(query ThreadsQuery) (ThreadsPage, error) {
+	page := ThreadsPage{Threads: []Thread{}}
+	resp, err := storage.db.Call17("inbox_threads", []interface{}{
+		query.Agent, optionalId(query.Cursor), pageSize(query.Limit),
+	})
+	if err != nil {
+		return page, err
+	} else if len(resp.Data) < 2 {
+		return page, errors.New("Unexpected response from inbox_threads")
+	}
+
+	threads, _ := resp.Data[0].([]interface{})
+	for _, d := range threads {
+		t := d.(map[interface{}]interface{})
+		latest, err := readAllFromMap(t["latest"].(map[interface{}]interface{}))
+		if err != nil {
+			return page, err
+		}
+		page.Threads = append(page.Threads, Thread{
+			Id:     int(t["thread_id"].(uint64)),
+			Latest: latest,
+			Unread: int(t["unread"].(uint64)),
+		})
+	}
+	if resp.Data[1] != nil {
+		nextCursor := int(resp.Data[1].(uint64))
+		page.NextCursor = &nextCursor
+	}
+	return page, nil
+}
+
+func (storage *TTStorage) thread(query ThreadQuery) (ReadPage, error) {
+	page := ReadPage{Messages: []ReadAll{}}
+	resp, err := storage.db.Call17("inbox_thread", []interface{}{
+		query.Agent, uint64(query.ThreadId), optionalId(query.Cursor), pageSize(query.Limit),
+	})
+	if err != nil {
+		return page, err
+	} else if len(resp.Data) < 2 {
+		return page, errors.New("Unexpected response from inbox_thread")
+	}
+
+	messages, _ := resp.Data[0].([]interface{})
+	for _, d := range messages {
+		current, err := readAllFromMap(d.(map[interface{}]interface{}))
+		if err != nil {
+			return page, err
+		}
+		page.Messages = append(page.Messages, current)
+	}
+	if resp.Data[1] != nil {
+		nextCursor := int(resp.Data[1].(uint64))
+		page.NextCursor = &nextCursor
+	}
+	return page, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The storages the parity tests run on: the in-memory one and, if TT_HOST is
+// set, tarantool, which has to be a new instance created by db/instance.lua
+func testStorages(t *testing.T) map[string]Storage {
+	memStorage := &MemStorage{}
+	if err := memStorage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storages := map[string]Storage{"memory": memStorage}
+	if host := os.Getenv("TT_HOST"); host != "" {
+		ttStorage := &TTStorage{}
+		if err := ttStorage.Init(host, os.Getenv("TT_USER"), os.Getenv("TT_PASS")); err != nil {
+			t.Fatal(err)
+		}
+		storages["tarantool"] = ttStorage
+	}
+	return storages
+}
+
+func pageIds(page ReadPage) []int {
+	ids := []int{}
+	for _, message := range page.Messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+func TestStorageParity(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			content := map[string]interface{}{"message": "hi"}
+
+			// The ids start at 0, as the sequence message_id
+			sent, err := storage.send(Message{Sender: "alice", Receivers: []string{"bob", "carol", "bob", ""}, Content: content})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []Delivery{
+				{"bob", DELIVERY_DELIVERED},
+				{"carol", DELIVERY_DELIVERED},
+				{"bob", DELIVERY_DUPLICATE},
+				{"", DELIVERY_REJECTED},
+			}
+			if sent.MessageId != 0 || !reflect.DeepEqual(sent.Receivers, expected) || sent.delivered() != 2 {
+				t.Fatalf("Unexpected send %+v", sent)
+			}
+
+			for i := 0; i < 4; i++ {
+				sent, err = storage.send(Message{Sender: "alice", Receivers: []string{"bob"}, Content: content})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if sent.MessageId != 4 {
+				t.Fatalf("Unexpected id %d", sent.MessageId)
+			}
+
+			page, err := storage.read(ReadQuery{Receiver: "bob", Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{0, 1}) || page.NextCursor == nil || *page.NextCursor != 1 {
+				t.Fatalf("Unexpected first page %v %v", ids, page.NextCursor)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "bob", Limit: 2, Cursor: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{2, 3}) || page.NextCursor == nil {
+				t.Fatalf("Unexpected second page %v", ids)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "bob", Limit: 2, Cursor: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{4}) || page.NextCursor != nil {
+				t.Fatalf("Unexpected last page %v", ids)
+			}
+			cursor := 3
+			page, err = storage.read(ReadQuery{Receiver: "bob", Limit: 2, Desc: true, Cursor: &cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{2, 1}) || page.NextCursor == nil || *page.NextCursor != 1 {
+				t.Fatalf("Unexpected desc page %v", ids)
+			}
+
+			if err := storage.set("bob", 1, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.set("bob", 3, true); err != nil {
+				t.Fatal(err)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "bob", OnlyUnread: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{0, 2, 4}) {
+				t.Fatalf("Unexpected unread %v", ids)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "bob", OnlyUnread: true, Desc: true, Limit: 1, Cursor: &cursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{2}) || page.NextCursor == nil {
+				t.Fatalf("Unexpected unread desc %v", ids)
+			}
+			if count, err := storage.countUnread("bob"); err != nil || count != 3 {
+				t.Fatal(count, err)
+			}
+
+			// The message stays until its last receiver deletes it
+			if err := storage.delete("bob", 0); err != nil {
+				t.Fatal(err)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "carol"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{0}) || page.Messages[0].Read {
+				t.Fatalf("Unexpected read of carol %v", ids)
+			}
+			if count, err := storage.countUnread("bob"); err != nil || count != 2 {
+				t.Fatal(count, err)
+			}
+
+			sent, err = storage.send(Message{Sender: "alice", Receivers: []string{"bob", ""}, Content: content, Atomic: true})
+			if err != ErrSendAborted || sent.Receivers[0].Status != DELIVERY_ABORTED {
+				t.Fatalf("Unexpected atomic send %+v %v", sent, err)
+			}
+			if count, err := storage.countUnread("bob"); err != nil || count != 2 {
+				t.Fatal(count, err)
+			}
+
+			// The expired messages are neither read nor counted
+			expired := time.Now().Add(-time.Second)
+			if _, err := storage.send(Message{Sender: "alice", Receivers: []string{"bob"}, Content: content, ExpiresAt: &expired}); err != nil {
+				t.Fatal(err)
+			}
+			if count, err := storage.countUnread("bob"); err != nil || count != 2 {
+				t.Fatal(count, err)
+			}
+			page, err = storage.read(ReadQuery{Receiver: "bob", OnlyUnread: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := pageIds(page); !reflect.DeepEqual(ids, []int{2, 4}) {
+				t.Fatalf("Unexpected unread %v", ids)
+			}
+		})
+	}
+}
+
+func TestReceivedParity(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			receiver := "https://example.org/person/P1"
+			activityId := "https://remote.example/create/1"
+			if _, found, err := storage.findReceived(receiver, activityId); err != nil || found {
+				t.Fatal(found, err)
+			}
+			id, err := storage.storeReceived(StoredActivity{
+				Actor: receiver, Type: "Create", Activity: "{}", Created: time.Now(), ActivityId: activityId,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The activities without an id are never found
+			if _, err := storage.storeReceived(StoredActivity{Actor: receiver, Type: "Like", Activity: "{}", Created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := storage.storeReceived(StoredActivity{Actor: receiver, Type: "Like", Activity: "{}", Created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			if found, ok, err := storage.findReceived(receiver, activityId); err != nil || !ok || found != id {
+				t.Fatal(found, ok, err)
+			}
+			if _, found, err := storage.findReceived(receiver+"/other", activityId); err != nil || found {
+				t.Fatal(found, err)
+			}
+		})
+	}
+}
+
+func TestThreadsParity(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			sent, err := storage.send(Message{Sender: "dave", Receivers: []string{"erin"}, Content: map[string]interface{}{"message": "hi"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			threadId := sent.MessageId
+			expired := time.Now().Add(-time.Second)
+			if _, err := storage.send(Message{
+				Sender: "dave", Receivers: []string{"erin"}, Content: map[string]interface{}{"message": "gone"},
+				ThreadId: &threadId, ExpiresAt: &expired,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The expired message is not the latest one, it is unread
+			// until it is removed
+			unread := func(expected int) {
+				t.Helper()
+				page, err := storage.threads(ThreadsQuery{Agent: "erin"})
+				if err != nil || len(page.Threads) != 1 {
+					t.Fatal(page, err)
+				}
+				if thread := page.Threads[0]; thread.Latest.Id != threadId || thread.Unread != expected {
+					t.Fatalf("Unexpected thread %+v", thread)
+				}
+			}
+			unread(2)
+			if _, err := storage.expireMessages(time.Now(), nil, 100); err != nil {
+				t.Fatal(err)
+			}
+			unread(1)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Messages are grouped in threads (conversations), a thread is identified by
+// the id of its first message. The thread of an agent has the messages it
+// has sent or received.
+
+type ThreadsQuery struct {
+	Agent string
+	// The id of the newest message of the last thread of the previous page
+	Cursor *int
+	Limit  int
+}
+
+type Thread struct {
+	Id     int     `json:"thread_id"`
+	Latest ReadAll `json:"latest"`
+	// Number of the messages of the thread not read by the agent
+	Unread int `json:"unread"`
+}
+
+type ThreadsPage struct {
+	Threads []Thread
+	// Nil if there are no more threads
+	NextCursor *int
+}
+
+type ThreadQuery struct {
+	Agent    string
+	ThreadId int
+	// The id of the last message of the previous page
+	Cursor *int
+	Limit  int
+}
+
+// Sets the thread of a message to be sent: the one of the message it
+// replies to, which the sender has to see, or the given one, which has to
+// be a thread of the sender
+func (inbox *Inbox) messageThread(message *Message) error {
+	if message.InReplyTo != nil {
+		thread, err := inbox.storage.messageThread(message.Sender, *message.InReplyTo)
+		if err != nil {
+			return err
+		}
+		if message.ThreadId != nil && *message.ThreadId != thread {
+			return apiErrorf(CODE_BAD_REQUEST, "Message %d is not in thread %d", *message.InReplyTo, *message.ThreadId)
+		}
+		message.ThreadId = &thread
+		return nil
+	}
+	if message.ThreadId != nil {
+		page, err := inbox.storage.thread(ThreadQuery{
+			Agent:    message.Sender,
+			ThreadId: *message.ThreadId,
+			Limit:    1,
+		})
+		if err != nil {
+			return err
+		}
+		if len(page.Messages) == 0 {
+			return fmt.Errorf("%w: thread %d", ErrNotFound, *message.ThreadId)
+		}
+	}
+	return nil
+}
+
+type ReadThreads struct {
+	Receiver string `json:"receiver"`
+	Limit    int    `json:"limit"`
+	Cursor   *int   `json:"cursor"`
+}
+
+// Lists the threads of the receiver, the one with the newest message first
+func (inbox *Inbox) threadsHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	var readThreads ReadThreads
+	err = json.Unmarshal(body, &readThreads)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), readThreads.Receiver)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	page, err := inbox.storage.threads(ThreadsQuery{
+		Agent:  readThreads.Receiver,
+		Cursor: readThreads.Cursor,
+		Limit:  readThreads.Limit,
+	})
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	result["success"] = true
+	result["threads"] = page.Threads
+	result["next_cursor"] = page.NextCursor
+}
+
+type ReadThread struct {
+	Receiver string `json:"receiver"`
+	ThreadId int    `json:"thread_id"`
+	Limit    int    `json:"limit"`
+	Cursor   *int   `json:"cursor"`
+}
+
+// Returns the messages of a thread of the receiver, the oldest first
+func (inbox *Inbox) threadHandler(c *gin.Context) {
+	result := map[string]interface{}{
+		"success": false,
+	}
+	defer respondJSON(c, result)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+
+	var readThread ReadThread
+	err = json.Unmarshal(body, &readThread)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	// Verify signature request
+	err = inbox.authenticate(body, c.Request.Header.Get("zenflows-sign"), readThread.Receiver)
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	page, err := inbox.storage.thread(ThreadQuery{
+		Agent:    readThread.Receiver,
+		ThreadId: readThread.ThreadId,
+		Cursor:   readThread.Cursor,
+		Limit:    readThread.Limit,
+	})
+	if err != nil {
+		setError(result, err)
+		return
+	}
+	// The threads of other agents are not disclosed
+	if len(page.Messages) == 0 && readThread.Cursor == nil {
+		setError(result, fmt.Errorf("%w: thread %d", ErrNotFound, readThread.ThreadId))
+		return
+	}
+
+	result["success"] = true
+	result["thread_id"] = readThread.ThreadId
+	result["messages"] = page.Messages
+	result["next_cursor"] = page.NextCursor
+}
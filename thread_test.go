@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dyne/zenflows-inbox/client"
+)
+
+func TestThreads(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob, carol := ti.client("alice"), ti.client("bob"), ti.client("carol")
+
+	if _, err := alice.Send([]string{"bob"}, map[string]interface{}{"message": "1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	page, err := bob.Read(client.ReadQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := page.Messages[0]
+	if first.ThreadId != first.Id || first.InReplyTo != nil {
+		t.Fatalf("Unexpected first message %+v", first)
+	}
+	if _, err := bob.Reply(first.Id, []string{"alice"}, map[string]interface{}{"message": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Send([]string{"bob"}, map[string]interface{}{"message": "other"}, false); err != nil {
+		t.Fatal(err)
+	}
+	// Only who sent or received a message can reply to it
+	_, err = carol.Reply(first.Id, []string{"alice"}, map[string]interface{}{"message": "x"})
+	expectCode(t, err, http.StatusNotFound, CODE_NOT_FOUND)
+
+	threads, err := alice.Threads(10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads.Threads) != 2 || threads.NextCursor != nil {
+		t.Fatalf("Unexpected threads %+v", threads)
+	}
+	if thread := threads.Threads[1]; thread.Id != first.Id || thread.Unread != 1 || thread.Latest.InReplyTo == nil {
+		t.Fatalf("Unexpected thread %+v", thread)
+	}
+	firstPage, err := alice.Threads(1, nil)
+	if err != nil || len(firstPage.Threads) != 1 || firstPage.NextCursor == nil {
+		t.Fatal(firstPage, err)
+	}
+	secondPage, err := alice.Threads(1, firstPage.NextCursor)
+	if err != nil || len(secondPage.Threads) != 1 || secondPage.Threads[0].Id != first.Id || secondPage.NextCursor != nil {
+		t.Fatal(secondPage, err)
+	}
+
+	messages, err := bob.Thread(first.Id, 0, nil)
+	if err != nil || len(messages.Messages) != 2 || messages.Messages[1].Sender != "bob" {
+		t.Fatal(messages, err)
+	}
+	_, err = carol.Thread(first.Id, 0, nil)
+	expectCode(t, err, http.StatusNotFound, CODE_NOT_FOUND)
+
+	status, result := ti.post(t, "/send", signed(map[string]interface{}{
+		"sender": "carol", "receivers": []string{"bob"}, "content": map[string]interface{}{"m": 3}, "thread_id": first.Id,
+	}))
+	if status != http.StatusNotFound || result["code"] != CODE_NOT_FOUND {
+		t.Fatal(status, result)
+	}
+}
+
+func TestReadTimes(t *testing.T) {
+	ti := newTestInbox(t)
+	alice, bob := ti.client("alice"), ti.client("bob")
+
+	if _, err := alice.Send([]string{"bob"}, map[string]interface{}{"message": "1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := alice.Send([]string{"bob"}, map[string]interface{}{"message": "2"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := bob.Read(client.ReadQuery{})
+	if err != nil || len(all.Messages) != 2 || all.Messages[0].Created.IsZero() ||
+		!all.Messages[0].Created.Before(all.Messages[1].Created) {
+		t.Fatal(all, err)
+	}
+	after, err := bob.Read(client.ReadQuery{Since: &middle})
+	if err != nil || len(after.Messages) != 1 || after.Messages[0].Content["message"] != "2" {
+		t.Fatal(after, err)
+	}
+	before, err := bob.Read(client.ReadQuery{Until: &middle, Order: "desc"})
+	if err != nil || len(before.Messages) != 1 || before.Messages[0].Content["message"] != "1" {
+		t.Fatal(before, err)
+	}
+
+	status, result := ti.post(t, "/read", signed(map[string]interface{}{"receiver": "bob", "since": "yesterday"}))
+	if status != http.StatusBadRequest || result["code"] != CODE_BAD_REQUEST {
+		t.Fatal(status, result)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Discovery of the actors and of the instance by the other servers of the
+// fediverse: WebFinger (RFC 7033), host-meta (RFC 6415) and NodeInfo
+
+const (
+	NODEINFO_NAME       = "zenflows-inbox"
+	NODEINFO_VERSION    = "0.1.0"
+	NODEINFO_REPOSITORY = "https://github.com/interfacerproject/zenflows-inbox-tarantool"
+)
+
+func baseHost() string {
+	baseUrl, err := url.Parse(os.Getenv("BASE_URL"))
+	if err != nil {
+		return ""
+	}
+	return baseUrl.Host
+}
+
+// Finds the person of a WebFinger resource, which is either
+// acct:<id or username>@<host> or the url of the actor
+func (inbox *Inbox) webfingerPerson(resource string) (*ZenflowsPerson, error) {
+	personUrl := os.Getenv("BASE_URL") + "/person/"
+	if strings.HasPrefix(resource, personUrl) {
+		return inbox.zenflowsAgent.GetPerson(strings.TrimPrefix(resource, personUrl))
+	}
+
+	acct := strings.TrimPrefix(resource, "acct:")
+	if acct == resource {
+		return nil, apiErrorf(CODE_NOT_FOUND, "Unknown resource %s", resource)
+	}
+	at := strings.LastIndex(acct, "@")
+	if at < 0 {
+		return nil, apiErrorf(CODE_NOT_FOUND, "Unknown resource %s", resource)
+	}
+	name, host := acct[:at], acct[at+1:]
+	if !strings.EqualFold(host, baseHost()) {
+		return nil, apiErrorf(CODE_NOT_FOUND, "Unknown host %s", host)
+	}
+	// The name is an id or, if zenflows does not know it, a username
+	person, err := inbox.zenflowsAgent.GetPerson(name)
+	if !errors.Is(err, ErrNotFound) {
+		return person, err
+	}
+	return inbox.zenflowsAgent.GetPersonByUser(name)
+}
+
+func (inbox *Inbox) webfingerHandler(c *gin.Context) {
+	resource := c.Query("resource")
+	if resource == "" {
+		abortWithError(c, apiErrorf(CODE_BAD_REQUEST, "No resource"))
+		return
+	}
+	person, err := inbox.webfingerPerson(resource)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	actorUrl := fmt.Sprintf("%s/person/%s", os.Getenv("BASE_URL"), person.Id)
+	subject := fmt.Sprintf("acct:%s@%s", person.Id, baseHost())
+	aliases := []string{actorUrl}
+	if person.User != "" {
+		aliases = append(aliases, subject)
+		subject = fmt.Sprintf("acct:%s@%s", person.User, baseHost())
+	}
+	renderJSON(c, http.StatusOK, "application/jrd+json; charset=utf-8", gin.H{
+		"subject": subject,
+		"aliases": aliases,
+		"links": []gin.H{
+			{
+				"rel":  "self",
+				"type": "application/activity+json",
+				"href": actorUrl,
+			},
+			{
+				"rel":  "http://webfinger.net/rel/profile-page",
+				"type": "text/html",
+				"href": actorUrl,
+			},
+		},
+	})
+}
+
+func (inbox *Inbox) hostMetaHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/xrd+xml; charset=utf-8", []byte(fmt.Sprintf(
+		`<?xml version="1.0" encoding="UTF-8"?>
+<XRD xmlns="http://docs.oasis-open.org/ns/xri/xrd-1.0">
+  <Link rel="lrdd" template="%s/.well-known/webfinger?resource={uri}"/>
+</XRD>
+`, os.Getenv("BASE_URL"))))
+}
+
+func (inbox *Inbox) nodeinfoLinksHandler(c *gin.Context) {
+	baseUrl := os.Getenv("BASE_URL")
+	c.JSON(http.StatusOK, gin.H{
+		"links": []gin.H{
+			{
+				"rel":  "http://nodeinfo.diaspora.software/ns/schema/2.1",
+				"href": baseUrl + "/nodeinfo/2.1",
+			},
+			{
+				"rel":  "http://nodeinfo.diaspora.software/ns/schema/2.0",
+				"href": baseUrl + "/nodeinfo/2.0",
+			},
+		},
+	})
+}
+
+// NodeInfo 2.0 and 2.1, the only difference is that 2.1 has the repository
+// of the software
+func (inbox *Inbox) nodeinfoHandler(version string) func(*gin.Context) {
+	return func(c *gin.Context) {
+		software := gin.H{
+			"name":    NODEINFO_NAME,
+			"version": NODEINFO_VERSION,
+		}
+		if version == "2.1" {
+			software["repository"] = NODEINFO_REPOSITORY
+		}
+		contentType := fmt.Sprintf(`application/json; profile="http://nodeinfo.diaspora.software/ns/schema/%s#"`, version)
+		renderJSON(c, http.StatusOK, contentType, gin.H{
+			"version":   version,
+			"software":  software,
+			"protocols": []string{"activitypub"},
+			"services": gin.H{
+				"inbound":  []string{},
+				"outbound": []string{},
+			},
+			// The people are registered in zenflows
+			"openRegistrations": false,
+			"usage": gin.H{
+				"users": gin.H{},
+			},
+			"metadata": gin.H{},
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWebfinger(t *testing.T) {
+	ti := newTestInbox(t)
+	host := strings.TrimPrefix(ti.server.URL, "http://")
+	ti.zenflows.setUser("P1", "pina")
+	ti.zenflows.setUnknown("pina")
+	ti.zenflows.setUnknown("nobody")
+	webfinger := func(resource string) (int, map[string]interface{}) {
+		return ti.do(t, "GET", "/.well-known/webfinger?resource="+url.QueryEscape(resource), nil, nil)
+	}
+
+	// By id, by username and by the url of the actor
+	for _, resource := range []string{"acct:P1@" + host, "acct:pina@" + host, ti.server.URL + "/person/P1"} {
+		status, jrd := webfinger(resource)
+		links, _ := jrd["links"].([]interface{})
+		if status != http.StatusOK || jrd["subject"] != "acct:pina@"+host || len(links) == 0 ||
+			links[0].(map[string]interface{})["href"] != ti.server.URL+"/person/P1" {
+			t.Fatal(resource, status, jrd)
+		}
+	}
+	for _, resource := range []string{"acct:nobody@" + host, "acct:P1@other.example", "mailto:P1@" + host} {
+		if status, result := webfinger(resource); status != http.StatusNotFound || result["code"] != CODE_NOT_FOUND {
+			t.Fatal(resource, status, result)
+		}
+	}
+	// An error of zenflows is not taken for an unknown person
+	ti.zenflows.setDown(true)
+	if status, result := webfinger("acct:P1@" + host); status != http.StatusBadGateway || result["code"] != CODE_ZENFLOWS_UNAVAILABLE {
+		t.Fatal(status, result)
+	}
+}
+
+func TestNodeinfo(t *testing.T) {
+	ti := newTestInbox(t)
+	status, links := ti.do(t, "GET", "/.well-known/nodeinfo", nil, nil)
+	if status != http.StatusOK {
+		t.Fatal(status, links)
+	}
+	for _, link := range links["links"].([]interface{}) {
+		href := link.(map[string]interface{})["href"].(string)
+		status, nodeinfo := ti.do(t, "GET", strings.TrimPrefix(href, ti.server.URL), nil, nil)
+		software, _ := nodeinfo["software"].(map[string]interface{})
+		if status != http.StatusOK || !strings.HasSuffix(href, "/"+nodeinfo["version"].(string)) ||
+			software["name"] != NODEINFO_NAME || nodeinfo["openRegistrations"] != false {
+			t.Fatal(href, status, nodeinfo)
+		}
+		if (nodeinfo["version"] == "2.1") != (software["repository"] != nil) {
+			t.Fatal(nodeinfo)
+		}
+	}
+
+	resp, err := http.Get(ti.server.URL + "/.well-known/host-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/xrd+xml") {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+}
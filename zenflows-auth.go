@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	_ "embed"
+	b64 "encoding/base64"
 	"encoding/json"
-	"errors"
+	"fmt"
 	zenroom "github.com/dyne/Zenroom/bindings/golang/zenroom"
 	"io"
 	"net/http"
+	"strconv"
 )
 
 const GQL_PERSON_PUBKEY string = "query($id: ID!) {personPubkey(id: $id)}"
@@ -23,8 +25,8 @@ type ZenroomResult struct {
 	Output []string `json:"output"`
 }
 
-// Fills ZenroomData with the public key requested to zenflows (from the email)
-func (data *ZenroomData) requestPublicKey(url string, id string) error {
+// Requests to zenflows the public key of the agent with the given id
+func fetchPublicKey(url string, id string) (string, error) {
 	query, err := json.Marshal(map[string]interface{}{
 		"query": GQL_PERSON_PUBKEY,
 		"variables": map[string]string{
@@ -33,18 +35,40 @@ func (data *ZenroomData) requestPublicKey(url string, id string) error {
 	})
 	resp, err := http.Post(url, "application/json", bytes.NewReader(query))
 	if err != nil {
-		return err
+		return "", fmt.Errorf("%w: %s", ErrZenflowsUnavailable, err.Error())
 	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("%w: %s", ErrZenflowsUnavailable, err.Error())
+	}
+	// zenflows answers with errors too when it does not know the agent
+	var result struct {
+		Data *struct {
+			PersonPubkey *string `json:"personPubkey"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Data == nil {
+		return "", fmt.Errorf("%w: %s", ErrZenflowsUnavailable, string(body))
 	}
-	var result map[string]map[string]string
-	json.Unmarshal(body, &result)
-	if result["data"]["personPubkey"] == "" {
-		return errors.New(string(body))
+	if pubkey := result.Data.PersonPubkey; pubkey != nil && *pubkey != "" {
+		return *pubkey, nil
 	}
-	data.EdDSAPublicKey = result["data"]["personPubkey"]
+	// zenflows answered, but it does not know the agent
+	return "", fmt.Errorf("%w: %s", ErrUnknownAgent, string(body))
+}
+
+// Fills ZenroomData with the public key of the agent (from the cache or
+// requested to zenflows)
+func (data *ZenroomData) requestPublicKey(pubkeys *PubkeyCache, id string) error {
+	pubkey, err := pubkeys.get(id)
+	if err != nil {
+		return err
+	}
+	data.EdDSAPublicKey = pubkey
 	return nil
 }
 
@@ -57,15 +81,56 @@ func (data *ZenroomData) isAuth() error {
 	// Verify the signature
 	result, success := zenroom.ZencodeExec(VERIFY, "", string(jsonData), "")
 	if !success {
-		return errors.New(result.Logs)
+		return fmt.Errorf("%w: %s", ErrBadSignature, result.Logs)
 	}
 	var zenroomResult ZenroomResult
 	err = json.Unmarshal([]byte(result.Output), &zenroomResult)
+	if err != nil || len(zenroomResult.Output) == 0 || zenroomResult.Output[0] != "1" {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Verifies that body is signed by the agent with the given id and that it
+// is not a replay of a previous request
+func (inbox *Inbox) authenticate(body []byte, signature string, id string) error {
+	pubkey, err := inbox.pubkeys.get(id)
 	if err != nil {
 		return err
 	}
-	if zenroomResult.Output[0] != "1" {
-		return errors.New("Signature is not authentic")
+	return inbox.authenticateWithKey(body, signature, id, pubkey)
+}
+
+// As authenticate, with the given public key of the agent
+func (inbox *Inbox) authenticateWithKey(body []byte, signature string, id string, pubkey string) error {
+	zenroomData := ZenroomData{
+		Gql:            b64.StdEncoding.EncodeToString(body),
+		EdDSASignature: signature,
+		EdDSAPublicKey: pubkey,
 	}
-	return nil
+	if err := zenroomData.isAuth(); err != nil {
+		return err
+	}
+	return inbox.replay.check(body, id)
+}
+
+// Verifies a request without body (a GET): the signature is of the path
+// with the query, which contains the timestamp and the nonce
+func (inbox *Inbox) authenticateGet(r *http.Request, id string) error {
+	zenroomData := ZenroomData{
+		Gql:            b64.StdEncoding.EncodeToString([]byte(r.URL.RequestURI())),
+		EdDSASignature: r.Header.Get("zenflows-sign"),
+	}
+	if err := zenroomData.requestPublicKey(inbox.pubkeys, id); err != nil {
+		return err
+	}
+	if err := zenroomData.isAuth(); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	timestamp, _ := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+	return inbox.replay.checkSigned(SignedRequest{
+		Timestamp: timestamp,
+		Nonce:     query.Get("nonce"),
+	}, id)
 }
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	b64 "encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	zenroom "github.com/dyne/Zenroom/bindings/golang/zenroom"
 	"io"
@@ -29,8 +28,9 @@ Then print 'gql' as 'base64'
 Then print 'hash' as 'hex'
 `
 
-const GQL_PERSON string = "query($id: ID!) {person(id: $id) {id name note}}"
-const GQL_ECONOMIC_RESOURCE string = "query($id: ID!) { economicResource(id: $id) { id name note}}"
+const GQL_PERSON string = "query($id: ID!) {person(id: $id) {id name note user}}"
+const GQL_PERSON_BY_USER string = "query($user: String!) {people(first: 10, filter: {user: $user}) {edges {node {id name note user}}}}"
+const GQL_ECONOMIC_RESOURCE string = "query($id: ID!) { economicResource(id: $id) { id name note primaryAccountable { id }}}"
 
 type ZenflowsAgent struct {
 	Sk          string
@@ -55,6 +55,7 @@ type ZenflowsPerson struct {
 	Id   string
 	Name string
 	Note string
+	User string
 }
 
 func (za *ZenflowsAgent) GetPerson(id string) (*ZenflowsPerson, error) {
@@ -69,22 +70,64 @@ func (za *ZenflowsAgent) GetPerson(id string) (*ZenflowsPerson, error) {
 	if err != nil {
 		return nil, err
 	}
-	var result map[string]map[string]map[string]string
-	json.Unmarshal(body, &result)
-	if result["data"]["person"] == nil {
-		return nil, errors.New("Error in the response from zenflows")
-	}
-	return &ZenflowsPerson{
-		Id:   result["data"]["person"]["id"],
-		Name: result["data"]["person"]["name"],
-		Note: result["data"]["person"]["note"],
-	}, nil
+	// Without data zenflows could not answer, the person is null if it does
+	// not exist
+	var result struct {
+		Data *struct {
+			Person *ZenflowsPerson
+		}
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrZenflowsUnavailable, string(body))
+	}
+	if result.Data.Person == nil {
+		return nil, fmt.Errorf("%w: person %s", ErrNotFound, id)
+	}
+	return result.Data.Person, nil
+}
+
+// Looks for the person with the given username
+func (za *ZenflowsAgent) GetPersonByUser(user string) (*ZenflowsPerson, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"query": GQL_PERSON_BY_USER,
+		"variables": map[string]string{
+			"user": user,
+		},
+	})
+
+	body, err := za.makeRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Data struct {
+			People struct {
+				Edges []struct {
+					Node ZenflowsPerson
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrZenflowsUnavailable, string(body))
+	}
+	// The filter could match more people, only the exact user is taken
+	for _, edge := range result.Data.People.Edges {
+		if edge.Node.User == user {
+			return &edge.Node, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: person %s", ErrNotFound, user)
 }
 
 type ZenflowsEconomicResource struct {
 	Id   string
 	Name string
 	Note string
+	// The agent responsible for the resource
+	PrimaryAccountable struct {
+		Id string
+	}
 }
 
 func (za *ZenflowsAgent) makeRequest(query []byte) ([]byte, error) {
@@ -98,14 +141,14 @@ func (za *ZenflowsAgent) makeRequest(query []byte) ([]byte, error) {
 	client := &http.Client{}
 	res, err := client.Do(r)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s", ErrZenflowsUnavailable, err.Error())
 	}
 
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s", ErrZenflowsUnavailable, err.Error())
 	}
 	return body, nil
 }
@@ -123,16 +166,16 @@ func (za *ZenflowsAgent) GetEconomicResource(id string) (*ZenflowsEconomicResour
 		return nil, err
 	}
 
-	var result map[string]map[string]map[string]string
+	var result struct {
+		Data struct {
+			EconomicResource *ZenflowsEconomicResource
+		}
+	}
 	json.Unmarshal(body, &result)
 
-	if result["data"]["economicResource"] == nil {
-		return nil, errors.New("Error in the response from zenflows")
+	if result.Data.EconomicResource == nil {
+		return nil, fmt.Errorf("%w: economic resource %s", ErrNotFound, id)
 	}
 
-	return &ZenflowsEconomicResource{
-		Id:   result["data"]["economicResource"]["id"],
-		Name: result["data"]["economicResource"]["name"],
-		Note: result["data"]["economicResource"]["note"],
-	}, nil
+	return result.Data.EconomicResource, nil
 }